@@ -0,0 +1,502 @@
+package backup
+
+import (
+	"atlas/internal/engine"
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A repository keeps every file of a backup once per distinct content, as an
+// object named by the SHA-256 of the contents. SSTables never change once
+// written, so successive backups of a store share all but the tables written
+// in between. Every backup is described by a manifest, written once all of
+// its objects are in place:
+//
+//	objects/<2 hex digits>/<62 hex digits> - file contents, read only
+//	backups/<id>.json                      - manifest of a backup
+//	staging/                               - objects being copied in
+//
+// A repository must not be used by several processes at once.
+type Repository struct {
+	dir string
+}
+
+type Backup struct {
+	ID        string
+	CreatedAt time.Time
+	// every write up to this sequence is in the backup
+	Sequence uint64
+	// size of the objects the backup added to the repository
+	AddedSize int64
+	Files     []BackupFile
+}
+
+// File of the checkpoint the backup was taken from.
+type BackupFile struct {
+	// relative to the checkpoint directory
+	Path    string
+	Object  string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backups beyond either limit are removed by `Purge`, the newest backup is
+// always kept. A zero value disables the limit.
+type RetentionPolicy struct {
+	KeepLast int
+	MaxAge   time.Duration
+}
+
+const (
+	objectsDir = "objects"
+	backupsDir = "backups"
+	stagingDir = "staging"
+	// suffix of the checkpoints `Create` writes next to the LSM directory
+	checkpointSuffix = "-backup-"
+	backupIDTime     = "20060102T150405.000Z"
+	// age past which staging entries and unreferenced objects are taken as
+	// left by an interrupted backup rather than one still in progress
+	staleEntryAge = 24 * time.Hour
+)
+
+var ErrBackupNotFound = errors.New("Backup not found")
+
+// Opens the repository in the directory, creating it if needed.
+func Open(dir string) (*Repository, error) {
+	for _, subdir := range []string{objectsDir, backupsDir, stagingDir} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Repository{dir: dir}, nil
+}
+
+// Directory objects are copied into before they are moved in place.
+func (repo *Repository) StagingDir() string {
+	return filepath.Join(repo.dir, stagingDir)
+}
+
+// Checkpoints the store and imports the checkpoint. The checkpoint is written
+// next to the LSM directory, so that its SSTables are hard links keeping the
+// modification times of the tables, and those unchanged since the latest
+// backup are not read again. Checkpoints left there by an interrupted backup
+// are removed once stale.
+func (repo *Repository) Create(atlas *engine.Atlas) (Backup, error) {
+	leftovers, err := filepath.Glob(atlas.LsmDir() + checkpointSuffix + "*")
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if err := removeStalePaths(leftovers); err != nil {
+		return Backup{}, err
+	}
+
+	checkpointDir := fmt.Sprintf("%s%s%d", atlas.LsmDir(), checkpointSuffix, time.Now().UnixNano())
+	if _, err := atlas.Checkpoint(checkpointDir); err != nil {
+		return Backup{}, err
+	}
+	defer os.RemoveAll(checkpointDir)
+
+	return repo.Import(checkpointDir)
+}
+
+// Backs up a checkpoint written by `Atlas.Checkpoint`. Only the files whose
+// contents are not in the repository yet are copied. SSTables unchanged since
+// the latest backup are not even read again.
+func (repo *Repository) Import(checkpointDir string) (Backup, error) {
+	info, err := engine.ReadCheckpointInfo(checkpointDir)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	backup := Backup{
+		ID:        info.CreatedAt.UTC().Format(backupIDTime),
+		CreatedAt: info.CreatedAt,
+		Sequence:  info.Sequence,
+		AddedSize: 0,
+		Files:     nil,
+	}
+	if _, err := os.Stat(repo.manifestFilename(backup.ID)); err == nil {
+		return Backup{}, fmt.Errorf("Failed importing checkpoint - backup %s already exists", backup.ID)
+	}
+
+	knownTables, err := repo.latestTables()
+	if err != nil {
+		return Backup{}, err
+	}
+
+	err = filepath.WalkDir(checkpointDir, func(filename string, dirEntry fs.DirEntry, err error) error {
+		if err != nil || dirEntry.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(checkpointDir, filename)
+		if err != nil {
+			return err
+		}
+
+		stat, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := BackupFile{Path: filepath.ToSlash(relative), Size: stat.Size(), ModTime: stat.ModTime()}
+		if known, contained := knownTables[file.Path]; contained && known.Size == file.Size && known.ModTime.Equal(file.ModTime) {
+			file.Object = known.Object
+			backup.Files = append(backup.Files, file)
+			return nil
+		}
+
+		object, added, err := repo.storeObject(filename)
+		if err != nil {
+			return err
+		}
+
+		file.Object = object
+		if added {
+			backup.AddedSize += file.Size
+		}
+		backup.Files = append(backup.Files, file)
+		return nil
+	})
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if err := repo.writeManifest(backup); err != nil {
+		return Backup{}, err
+	}
+
+	logger.Info(
+		"Created backup %s of %d files at sequence %d, adding %d bytes",
+		backup.ID, len(backup.Files), backup.Sequence, backup.AddedSize,
+	)
+	return backup, nil
+}
+
+// Returns the backups from the oldest to the newest.
+func (repo *Repository) List() ([]Backup, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(repo.dir, backupsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, dirEntry := range dirEntries {
+		id, isManifest := strings.CutSuffix(dirEntry.Name(), ".json")
+		if dirEntry.IsDir() || !isManifest {
+			continue
+		}
+
+		backup, err := repo.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+
+	slices.SortFunc(backups, func(b1, b2 Backup) int {
+		return b1.CreatedAt.Compare(b2.CreatedAt)
+	})
+	return backups, nil
+}
+
+func (repo *Repository) Get(id string) (Backup, error) {
+	var backup Backup
+	data, err := os.ReadFile(repo.manifestFilename(id))
+	if os.IsNotExist(err) {
+		return backup, ErrBackupNotFound
+	}
+
+	if err != nil {
+		return backup, err
+	}
+
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backup, fmt.Errorf("Failed reading manifest of backup %s: %w", id, err)
+	}
+	return backup, nil
+}
+
+// Reads every object of the backup back and checks it against its name and
+// size.
+func (repo *Repository) Verify(id string) error {
+	backup, err := repo.Get(id)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, file := range backup.Files {
+		object, size, err := hashFile(repo.objectFilename(file.Object))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed reading %s: %w", file.Path, err))
+			continue
+		}
+
+		if object != file.Object || size != file.Size {
+			errs = append(errs, fmt.Errorf("Contents of %s do not match the manifest", file.Path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Writes the checkpoint the backup was taken from into the directory, which
+// must not exist yet. `engine.CheckpointConfig` opens it as a store.
+func (repo *Repository) Restore(id, dir string) error {
+	backup, err := repo.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range backup.Files {
+		filename := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+
+		if err := utils.CopyFile(repo.objectFilename(file.Object), filename, 0644); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Restored backup %s into %s", backup.ID, dir)
+	return nil
+}
+
+// Removes the backups beyond the retention policy, then the objects no backup
+// refers to anymore, and returns the ids of the removed backups. Unreferenced
+// objects and staging entries are only removed once stale, so that a backup
+// being created meanwhile keeps its checkpoint and new objects.
+func (repo *Repository) Purge(policy RetentionPolicy) ([]string, error) {
+	backups, err := repo.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	referenced := make(map[string]bool)
+	for idx, backup := range slices.Backward(backups) {
+		age := len(backups) - 1 - idx
+		expired := policy.MaxAge > 0 && time.Since(backup.CreatedAt) > policy.MaxAge
+		if age > 0 && (expired || (policy.KeepLast > 0 && age >= policy.KeepLast)) {
+			if err := os.Remove(repo.manifestFilename(backup.ID)); err != nil {
+				return removed, err
+			}
+			removed = append(removed, backup.ID)
+			continue
+		}
+
+		for _, file := range backup.Files {
+			referenced[file.Object] = true
+		}
+	}
+
+	freed, err := repo.removeObjects(referenced)
+	if err != nil {
+		return removed, err
+	}
+
+	if err := removeStaleEntries(repo.StagingDir()); err != nil {
+		return removed, err
+	}
+
+	logger.Info("Purged %d backups, freeing %d bytes", len(removed), freed)
+	return removed, nil
+}
+
+// SSTables of the latest backup by their path, whose objects can be reused
+// for identical tables.
+func (repo *Repository) latestTables() (map[string]BackupFile, error) {
+	backups, err := repo.List()
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+
+	tables := make(map[string]BackupFile)
+	for _, file := range backups[len(backups)-1].Files {
+		if strings.HasSuffix(file.Path, ".sstable") {
+			tables[file.Path] = file
+		}
+	}
+	return tables, nil
+}
+
+// Copies the file into the repository unless an object with the same
+// contents exists, and returns its name and whether it was added.
+func (repo *Repository) storeObject(filename string) (string, bool, error) {
+	object, _, err := hashFile(filename)
+	if err != nil {
+		return "", false, err
+	}
+
+	objectFilename := repo.objectFilename(object)
+	if _, err := os.Stat(objectFilename); err == nil {
+		// a purge running meanwhile takes the reused object as recent
+		now := time.Now()
+		if err := os.Chtimes(objectFilename, now, now); err != nil {
+			return "", false, err
+		}
+		return object, false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectFilename), 0755); err != nil {
+		return "", false, err
+	}
+
+	// written under a temporary name, so that an interrupted copy never
+	// passes for the object
+	tmpFilename := filepath.Join(repo.StagingDir(), object+".tmp")
+	if err := utils.CopyFile(filename, tmpFilename, 0444); err != nil {
+		os.Remove(tmpFilename)
+		return "", false, err
+	}
+
+	if err := os.Rename(tmpFilename, objectFilename); err != nil {
+		os.Remove(tmpFilename)
+		return "", false, err
+	}
+	return object, true, utils.SyncDir(filepath.Dir(objectFilename))
+}
+
+func (repo *Repository) removeObjects(referenced map[string]bool) (int64, error) {
+	var freed int64
+	err := filepath.WalkDir(filepath.Join(repo.dir, objectsDir), func(filename string, dirEntry fs.DirEntry, err error) error {
+		if err != nil || dirEntry.IsDir() {
+			return err
+		}
+
+		object := filepath.Base(filepath.Dir(filename)) + dirEntry.Name()
+		if referenced[object] {
+			return nil
+		}
+
+		stat, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+
+		if time.Since(stat.ModTime()) < staleEntryAge {
+			return nil
+		}
+
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		freed += stat.Size()
+		return nil
+	})
+	return freed, err
+}
+
+func (repo *Repository) writeManifest(backup Backup) error {
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := repo.manifestFilename(backup.ID)
+	tmpFilename := filename + ".tmp"
+	if err := writeFile(tmpFilename, data); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(filename))
+}
+
+func (repo *Repository) manifestFilename(id string) string {
+	return filepath.Join(repo.dir, backupsDir, id+".json")
+}
+
+func (repo *Repository) objectFilename(object string) string {
+	return filepath.Join(repo.dir, objectsDir, object[:2], object[2:])
+}
+
+func hashFile(filename string) (string, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func writeFile(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func removeStaleEntries(dir string) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		paths = append(paths, filepath.Join(dir, dirEntry.Name()))
+	}
+	return removeStalePaths(paths)
+}
+
+func removeStalePaths(paths []string) error {
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if time.Since(stat.ModTime()) < staleEntryAge {
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
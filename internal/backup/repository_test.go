@@ -0,0 +1,320 @@
+package backup
+
+import (
+	"atlas/internal/engine"
+	"atlas/internal/storage"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAtlasConfig(dir string) engine.AtlasConfig {
+	return engine.AtlasConfig{
+		Lsm: storage.LsmConfig{
+			Dir:       filepath.Join(dir, "lsm"),
+			BlockSize: 256,
+			Levels: []storage.LsmLevelConfig{
+				{MaxFileSize: 4096, MaxTables: 4},
+				{MaxFileSize: 8192},
+			},
+		},
+		Wal: storage.WalConfig{
+			Dir:        filepath.Join(dir, "wal"),
+			MaxEntries: 100,
+		},
+	}
+}
+
+func openTestAtlas(t *testing.T, config engine.AtlasConfig) *engine.Atlas {
+	t.Helper()
+
+	atlas, err := engine.NewAtlas(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { atlas.Close() })
+	return atlas
+}
+
+func insertTestKeys(t *testing.T, atlas *engine.Atlas, from, to int) {
+	t.Helper()
+
+	for idx := from; idx < to; idx++ {
+		if err := atlas.Insert(fmt.Sprintf("key%05d", idx), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func createTestBackup(t *testing.T, repo *Repository, atlas *engine.Atlas) Backup {
+	t.Helper()
+
+	backup, err := repo.Create(atlas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// backup ids have millisecond precision
+	time.Sleep(2 * time.Millisecond)
+	return backup
+}
+
+func TestRepositoryBacksUpIncrementally(t *testing.T) {
+	dir := t.TempDir()
+	atlas := openTestAtlas(t, testAtlasConfig(dir))
+	repo, err := Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestKeys(t, atlas, 0, 2000)
+	first := createTestBackup(t, repo, atlas)
+	insertTestKeys(t, atlas, 2000, 2050)
+	second := createTestBackup(t, repo, atlas)
+
+	if second.Sequence <= first.Sequence {
+		t.Fatalf("second backup at sequence %d, first at %d", second.Sequence, first.Sequence)
+	}
+
+	var totalSize int64
+	for _, file := range second.Files {
+		totalSize += file.Size
+	}
+
+	if second.AddedSize == 0 || second.AddedSize >= totalSize {
+		t.Fatalf("second backup added %d of %d bytes", second.AddedSize, totalSize)
+	}
+
+	backups, err := repo.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 2 || backups[0].ID != first.ID || backups[1].ID != second.ID {
+		t.Fatalf("listed %v", backups)
+	}
+
+	for _, backup := range backups {
+		if err := repo.Verify(backup.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	staged, err := os.ReadDir(repo.StagingDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(staged) != 0 {
+		t.Fatalf("created backups left %d staging entries", len(staged))
+	}
+}
+
+func TestRepositoryRestoresBackup(t *testing.T) {
+	dir := t.TempDir()
+	config := testAtlasConfig(dir)
+	atlas := openTestAtlas(t, config)
+	repo, err := Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestKeys(t, atlas, 0, 500)
+	backup := createTestBackup(t, repo, atlas)
+	insertTestKeys(t, atlas, 500, 600)
+
+	restoredDir := filepath.Join(dir, "restored")
+	if err := repo.Restore(backup.ID, restoredDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Restore(backup.ID, restoredDir); err == nil {
+		t.Fatal("restoring into an existing directory succeeded")
+	}
+
+	restoredConfig, err := engine.CheckpointConfig(restoredDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openTestAtlas(t, restoredConfig)
+
+	entries, err := restored.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 500 {
+		t.Fatalf("restored %d keys, expected 500", len(entries))
+	}
+}
+
+func TestRepositoryVerifyDetectsDamagedObjects(t *testing.T) {
+	dir := t.TempDir()
+	atlas := openTestAtlas(t, testAtlasConfig(dir))
+	repo, err := Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestKeys(t, atlas, 0, 300)
+	backup := createTestBackup(t, repo, atlas)
+
+	filename := repo.objectFilename(backup.Files[0].Object)
+	if err := os.Chmod(filename, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Verify(backup.ID); err == nil {
+		t.Fatal("verifying a damaged backup succeeded")
+	}
+
+	if err := repo.Verify("missing"); err != ErrBackupNotFound {
+		t.Fatalf("verifying a missing backup returned %v", err)
+	}
+}
+
+func TestRepositoryPurge(t *testing.T) {
+	dir := t.TempDir()
+	atlas := openTestAtlas(t, testAtlasConfig(dir))
+	repo, err := Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backups []Backup
+	for idx := range 3 {
+		insertTestKeys(t, atlas, idx*500, (idx+1)*500)
+		backups = append(backups, createTestBackup(t, repo, atlas))
+	}
+
+	// objects and staging entries left by an interrupted backup, one of them
+	// still in progress
+	staleTime := time.Now().Add(-2 * staleEntryAge)
+	staleObject := repo.objectFilename("00" + fmt.Sprintf("%062d", 1))
+	freshObject := repo.objectFilename("00" + fmt.Sprintf("%062d", 2))
+	staleStaged := filepath.Join(repo.StagingDir(), fmt.Sprintf("%064d.tmp", 1))
+	freshStaged := filepath.Join(repo.StagingDir(), fmt.Sprintf("%064d.tmp", 2))
+	for _, filename := range []string{staleObject, freshObject, staleStaged, freshStaged} {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filename, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, filename := range []string{staleObject, staleStaged} {
+		if err := os.Chtimes(filename, staleTime, staleTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := repo.Purge(RetentionPolicy{KeepLast: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != backups[0].ID {
+		t.Fatalf("purge removed %v", removed)
+	}
+
+	if _, err := repo.Get(backups[0].ID); err != ErrBackupNotFound {
+		t.Fatalf("purged backup returned %v", err)
+	}
+
+	for _, backup := range backups[1:] {
+		if err := repo.Verify(backup.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, filename := range []string{staleObject, staleStaged} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("stale %s was kept", filename)
+		}
+	}
+
+	for _, filename := range []string{freshObject, freshStaged} {
+		if _, err := os.Stat(filename); err != nil {
+			t.Fatalf("fresh %s was removed: %v", filename, err)
+		}
+	}
+
+	// the newest backup is kept past its age
+	removed, err = repo.Purge(RetentionPolicy{MaxAge: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != backups[1].ID {
+		t.Fatalf("purge by age removed %v", removed)
+	}
+
+	if err := repo.Verify(backups[2].ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepositoryCreateCheckpointsNextToStore(t *testing.T) {
+	dir := t.TempDir()
+	config := testAtlasConfig(dir)
+	atlas := openTestAtlas(t, config)
+	repo, err := Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// left by an interrupted backup
+	staleCheckpoint := config.Lsm.Dir + checkpointSuffix + "1"
+	if err := os.Mkdir(staleCheckpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	staleTime := time.Now().Add(-2 * staleEntryAge)
+	if err := os.Chtimes(staleCheckpoint, staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestKeys(t, atlas, 0, 1000)
+	first := createTestBackup(t, repo, atlas)
+	insertTestKeys(t, atlas, 1000, 1050)
+	second := createTestBackup(t, repo, atlas)
+
+	// the tables are hard linked into the checkpoints, so those unchanged
+	// keep their modification time and are recognized without being read
+	firstTables := make(map[string]BackupFile)
+	for _, file := range first.Files {
+		firstTables[file.Path] = file
+	}
+
+	unchanged := 0
+	for _, file := range second.Files {
+		if known, contained := firstTables[file.Path]; contained && strings.HasSuffix(file.Path, ".sstable") {
+			if !known.ModTime.Equal(file.ModTime) {
+				t.Fatalf("table %s was backed up with modification times %v and %v", file.Path, known.ModTime, file.ModTime)
+			}
+			unchanged += 1
+		}
+	}
+
+	if unchanged == 0 {
+		t.Fatal("no table is shared by the backups")
+	}
+
+	leftovers, err := filepath.Glob(config.Lsm.Dir + checkpointSuffix + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leftovers) != 0 {
+		t.Fatalf("created backups left checkpoints %v", leftovers)
+	}
+}
@@ -1,35 +1,85 @@
 package common
 
 import (
+	"cmp"
+	"encoding/binary"
 	"errors"
-	"fmt"
+	"math"
 	"strings"
 	"time"
 )
 
+type EntryType byte
+
+const (
+	EntryPut EntryType = iota + 1
+	EntryDelete
+	// Reserved for merge operands, which are not produced by the engine yet.
+	EntryMerge
+)
+
 type Entry struct {
 	key       string
 	value     string
-	isDead    bool
+	kind      EntryType
 	timestamp int64
+	sequence  uint64
+	// Unix milliseconds after which the entry reads as deleted. Zero for
+	// entries which never expire.
+	expiresAt int64
 }
 
-const keyValueDelimiter = "|"
+// Binary record layout:
+//
+//	header    byte    - entry type in the low nibble, flags in the high one
+//	timestamp uvarint - present when `entryFlagTimestamp` is set
+//	sequence  uvarint - present when `entryFlagSequence` is set
+//	expiresAt uvarint - present when `entryFlagExpiry` is set
+//	keyLen    uvarint
+//	key       [keyLen]byte
+//	valueLen  uvarint
+//	value     [valueLen]byte
+//
+// New optional fields are introduced behind new flags, so older records stay
+// readable.
+const (
+	entryTypeMask      byte = 0x0f
+	entryFlagTimestamp byte = 1 << 4
+	entryFlagSequence  byte = 1 << 5
+	entryFlagExpiry    byte = 1 << 6
+	entryKnownFlags         = entryFlagTimestamp | entryFlagSequence | entryFlagExpiry
+)
+
+// Sequence which sees every write, used by reads of the latest state.
+const MaxSequence uint64 = math.MaxUint64
+
+var ErrShortEntry = errors.New("Failed decoding entry - record is truncated")
+
+const legacyKeyValueDelimiter = "|"
 
 func NewEntry(key, value string) *Entry {
 	return &Entry{
 		key:       key,
 		value:     value,
-		isDead:    false,
+		kind:      EntryPut,
 		timestamp: time.Now().UnixMilli(),
 	}
 }
 
+// Entry which expires once the TTL elapses from its creation. Expiry times are
+// kept in milliseconds, so the TTL is rounded up to whole milliseconds rather
+// than truncated, which would leave a positive TTL under 1ms expired at once.
+func NewEntryWithTTL(key, value string, ttl time.Duration) *Entry {
+	entry := NewEntry(key, value)
+	entry.expiresAt = entry.timestamp + (ttl + time.Millisecond - 1).Milliseconds()
+	return entry
+}
+
 func NewEmptyEntry(key string) *Entry {
 	return &Entry{
 		key:       key,
 		value:     "",
-		isDead:    true,
+		kind:      EntryDelete,
 		timestamp: time.Now().UnixMilli(),
 	}
 }
@@ -39,57 +89,214 @@ func (entry *Entry) Key() string {
 }
 
 func (entry *Entry) Value() (string, bool) {
-	if entry.isDead {
+	if entry.IsDead() {
 		return "", false
 	}
 	return entry.value, true
 }
 
+func (entry *Entry) Type() EntryType {
+	return entry.kind
+}
+
 func (entry *Entry) Timestamp() int64 {
 	return entry.timestamp
 }
 
+// Position of the write in the global order of writes. Entries written before
+// sequence numbers were persisted have a sequence of 0.
+func (entry *Entry) Sequence() uint64 {
+	return entry.sequence
+}
+
+func (entry *Entry) SetSequence(sequence uint64) {
+	entry.sequence = sequence
+}
+
 func (entry *Entry) IsDead() bool {
-	return entry.isDead
+	return entry.kind == EntryDelete
+}
+
+// Unix milliseconds after which the entry reads as deleted, zero when it never
+// expires.
+func (entry *Entry) ExpiresAt() int64 {
+	return entry.expiresAt
+}
+
+// Reports whether the entry has expired by `now`, in Unix milliseconds.
+func (entry *Entry) IsExpired(now int64) bool {
+	return entry.expiresAt != 0 && entry.expiresAt <= now
+}
+
+// Reports whether the entry holds a value at `now`, in Unix milliseconds.
+// Deleted and expired entries do not.
+func (entry *Entry) IsLive(now int64) bool {
+	return !entry.IsDead() && !entry.IsExpired(now)
 }
 
 func (entry *Entry) Kill() {
-	entry.isDead = true
+	entry.kind = EntryDelete
 	entry.value = ""
+	entry.expiresAt = 0
 }
 
 func CompareEntries(e1 *Entry, e2 *Entry) int {
 	return strings.Compare(e1.key, e2.key)
 }
 
-func (entry *Entry) Serialize() string {
-	if entry.isDead {
-		return fmt.Sprintf("%s\n", entry.key)
+// Orders versions of entries by key and then from the newest to the oldest.
+func CompareVersions(e1 *Entry, e2 *Entry) int {
+	if result := strings.Compare(e1.key, e2.key); result != 0 {
+		return result
 	}
-	return fmt.Sprintf("%s%s%s\n",
-		entry.key, keyValueDelimiter, entry.value,
-	)
+	return cmp.Compare(e2.sequence, e1.sequence)
 }
 
-func DeserializeEntry(serialized string) (*Entry, error) {
-	split := strings.Split(serialized, keyValueDelimiter)
-	if len(split) == 0 || len(split) > 2 {
-		return nil, errors.New("Failed deseiralizing entry - invalid format")
+// Reports whether the entry is a newer write than the other one.
+func (entry *Entry) IsNewerThan(other *Entry) bool {
+	return entry.sequence > other.sequence
+}
+
+func (entry *Entry) EncodedSize() int {
+	size := 1 +
+		uvarintSize(uint64(entry.timestamp)) +
+		uvarintSize(entry.sequence) +
+		uvarintSize(uint64(len(entry.key))) + len(entry.key) +
+		uvarintSize(uint64(len(entry.value))) + len(entry.value)
+	if entry.expiresAt != 0 {
+		size += uvarintSize(uint64(entry.expiresAt))
+	}
+	return size
+}
+
+func (entry *Entry) Encode() []byte {
+	return entry.AppendEncoded(make([]byte, 0, entry.EncodedSize()))
+}
+
+func (entry *Entry) AppendEncoded(buffer []byte) []byte {
+	header := byte(entry.kind) | entryFlagTimestamp | entryFlagSequence
+	if entry.expiresAt != 0 {
+		header |= entryFlagExpiry
 	}
 
-	isDead := len(split) == 1
+	buffer = append(buffer, header)
+	buffer = binary.AppendUvarint(buffer, uint64(entry.timestamp))
+	buffer = binary.AppendUvarint(buffer, entry.sequence)
+	if entry.expiresAt != 0 {
+		buffer = binary.AppendUvarint(buffer, uint64(entry.expiresAt))
+	}
+	buffer = binary.AppendUvarint(buffer, uint64(len(entry.key)))
+	buffer = append(buffer, entry.key...)
+	buffer = binary.AppendUvarint(buffer, uint64(len(entry.value)))
+	buffer = append(buffer, entry.value...)
+	return buffer
+}
 
-	var value string
-	if isDead {
-		value = ""
-	} else {
-		value = split[1]
+// Decodes the record at the start of the buffer and returns the number of
+// bytes it occupies. Returns `ErrShortEntry` when the buffer ends mid-record.
+func DecodeEntry(buffer []byte) (*Entry, int, error) {
+	if len(buffer) == 0 {
+		return nil, 0, ErrShortEntry
 	}
 
+	header := buffer[0]
+	kind := EntryType(header & entryTypeMask)
+	flags := header &^ entryTypeMask
+	if kind < EntryPut || kind > EntryMerge {
+		return nil, 0, errors.New("Failed decoding entry - unknown entry type")
+	}
+
+	if flags&^entryKnownFlags != 0 {
+		return nil, 0, errors.New("Failed decoding entry - unknown entry flags")
+	}
+
+	offset := 1
+	var timestamp int64 = 0
+	if flags&entryFlagTimestamp != 0 {
+		value, read := binary.Uvarint(buffer[offset:])
+		if read <= 0 {
+			return nil, 0, ErrShortEntry
+		}
+		timestamp = int64(value)
+		offset += read
+	}
+
+	var sequence uint64 = 0
+	if flags&entryFlagSequence != 0 {
+		value, read := binary.Uvarint(buffer[offset:])
+		if read <= 0 {
+			return nil, 0, ErrShortEntry
+		}
+		sequence = value
+		offset += read
+	}
+
+	var expiresAt int64 = 0
+	if flags&entryFlagExpiry != 0 {
+		value, read := binary.Uvarint(buffer[offset:])
+		if read <= 0 {
+			return nil, 0, ErrShortEntry
+		}
+		expiresAt = int64(value)
+		offset += read
+	}
+
+	key, read, err := decodeString(buffer[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += read
+
+	value, read, err := decodeString(buffer[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += read
+
 	return &Entry{
-		key:       split[0],
+		key:       key,
 		value:     value,
-		isDead:    isDead,
-		timestamp: time.Now().UnixMilli(),
-	}, nil
+		kind:      kind,
+		timestamp: timestamp,
+		sequence:  sequence,
+		expiresAt: expiresAt,
+	}, offset, nil
+}
+
+// Parses the `key|value` text format used before the binary encoding. A line
+// without a delimiter is a tombstone. Neither the write time nor the sequence
+// were persisted, so both are left unset.
+func DeserializeLegacyEntry(serialized string) (*Entry, error) {
+	serialized = strings.TrimSuffix(serialized, "\n")
+	split := strings.Split(serialized, legacyKeyValueDelimiter)
+	if len(split) == 0 || len(split) > 2 {
+		return nil, errors.New("Failed deseiralizing entry - invalid format")
+	}
+
+	if len(split) == 1 {
+		return &Entry{key: split[0], value: "", kind: EntryDelete}, nil
+	}
+	return &Entry{key: split[0], value: split[1], kind: EntryPut}, nil
+}
+
+func decodeString(buffer []byte) (string, int, error) {
+	length, read := binary.Uvarint(buffer)
+	if read <= 0 {
+		return "", 0, ErrShortEntry
+	}
+
+	end := uint64(read) + length
+	if end > uint64(len(buffer)) {
+		return "", 0, ErrShortEntry
+	}
+	return string(buffer[read:end]), int(end), nil
+}
+
+func uvarintSize(value uint64) int {
+	size := 1
+	for value >= 0x80 {
+		value >>= 7
+		size += 1
+	}
+	return size
 }
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewEntryWithTTLRoundsUpToMilliseconds(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Nanosecond, time.Microsecond, 999 * time.Microsecond} {
+		entry := NewEntryWithTTL("a", "1", ttl)
+		if entry.ExpiresAt() != entry.Timestamp()+1 {
+			t.Errorf("TTL of %v expires %dms after the write", ttl, entry.ExpiresAt()-entry.Timestamp())
+		}
+
+		if entry.IsExpired(entry.Timestamp()) {
+			t.Errorf("TTL of %v has expired when written", ttl)
+		}
+	}
+
+	entry := NewEntryWithTTL("a", "1", 1500*time.Microsecond)
+	if entry.ExpiresAt() != entry.Timestamp()+2 {
+		t.Fatalf("TTL of 1.5ms expires %dms after the write", entry.ExpiresAt()-entry.Timestamp())
+	}
+}
+
+func TestEntryExpiry(t *testing.T) {
+	entry := NewEntryWithTTL("a", "1", time.Second)
+	written := entry.Timestamp()
+
+	if !entry.IsLive(written+999) || entry.IsExpired(written+999) {
+		t.Fatal("entry expired before its TTL elapsed")
+	}
+
+	if entry.IsLive(written+1000) || !entry.IsExpired(written+1000) {
+		t.Fatal("entry is live after its TTL elapsed")
+	}
+
+	// the value is still returned, expiry is up to the reader
+	if value, _ := entry.Value(); value != "1" {
+		t.Fatalf("expired entry holds %q", value)
+	}
+
+	entry.Kill()
+	if entry.ExpiresAt() != 0 || entry.IsExpired(written+1000) {
+		t.Fatal("tombstone keeps the expiry")
+	}
+
+	if NewEntry("a", "1").IsExpired(written + 1000) {
+		t.Fatal("entry without a TTL expired")
+	}
+}
+
+func TestEntryExpiryRoundTrip(t *testing.T) {
+	entry := NewEntryWithTTL("a", "1", time.Minute)
+	entry.SetSequence(7)
+
+	decoded, read, err := DecodeEntry(entry.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read != entry.EncodedSize() || decoded.ExpiresAt() != entry.ExpiresAt() || decoded.Sequence() != 7 {
+		t.Fatalf("decoded %+v from %+v", decoded, entry)
+	}
+}
+
+func TestEntryEncodingRoundTrip(t *testing.T) {
+	entries := []*Entry{
+		NewEntry("key", "value"),
+		NewEntry("key|with\ndelimiters", "value|with\ndelimiters"),
+		NewEntry("", ""),
+		NewEmptyEntry("deleted"),
+		NewEntry("unicode ключ", string(make([]byte, 300))),
+	}
+
+	var buffer []byte
+	for idx, entry := range entries {
+		entry.SetSequence(uint64(idx) << 40)
+		buffer = entry.AppendEncoded(buffer)
+	}
+
+	for _, entry := range entries {
+		decoded, read, err := DecodeEntry(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer = buffer[read:]
+
+		if read != entry.EncodedSize() || *decoded != *entry {
+			t.Fatalf("decoded %+v from %d bytes, encoded %+v in %d", decoded, read, entry, entry.EncodedSize())
+		}
+	}
+}
+
+func TestDecodeEntryReportsTruncatedRecords(t *testing.T) {
+	entry := NewEntryWithTTL("key", "value", time.Minute)
+	encoded := entry.Encode()
+	for size := range len(encoded) {
+		if _, _, err := DecodeEntry(encoded[:size]); err != ErrShortEntry {
+			t.Fatalf("decoding %d of %d bytes returned %v", size, len(encoded), err)
+		}
+	}
+}
+
+func TestDecodeEntryRejectsUnknownHeaders(t *testing.T) {
+	encoded := NewEntry("key", "value").Encode()
+	for _, header := range []byte{0, byte(EntryMerge) + 1, encoded[0] | 1<<7} {
+		record := append([]byte{header}, encoded[1:]...)
+		if _, _, err := DecodeEntry(record); err == nil || err == ErrShortEntry {
+			t.Errorf("decoding header %#x returned %v", header, err)
+		}
+	}
+}
+
+func TestDecodeEntryWithoutOptionalFields(t *testing.T) {
+	record := []byte{byte(EntryPut), 1, 'k', 1, 'v'}
+	entry, read, err := DecodeEntry(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := entry.Value(); read != len(record) || entry.Key() != "k" || value != "v" || entry.Sequence() != 0 || entry.Timestamp() != 0 {
+		t.Fatalf("decoded %+v from %d bytes", entry, read)
+	}
+}
+
+func TestDeserializeLegacyEntry(t *testing.T) {
+	entry, err := DeserializeLegacyEntry("key|value\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, isAlive := entry.Value(); entry.Key() != "key" || value != "value" || !isAlive {
+		t.Fatalf("deserialized %+v", entry)
+	}
+
+	entry, err = DeserializeLegacyEntry("key\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Key() != "key" || !entry.IsDead() {
+		t.Fatalf("deserialized %+v from a tombstone", entry)
+	}
+
+	if _, err := DeserializeLegacyEntry("key|value|extra\n"); err == nil {
+		t.Fatal("deserialized an entry with two delimiters")
+	}
+}
@@ -0,0 +1,386 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Point up to which `RecoverToPoint` replays the archived writes. Zero fields
+// are ignored, a zero target replays every archived write.
+type RecoveryTarget struct {
+	// last sequence to recover
+	Sequence uint64
+	// writes made after this time are not recovered
+	Time time.Time
+}
+
+// Moves the flushed segments into the archive and removes the archived ones
+// past their retention.
+func (atlas *Atlas) archiveSegments(segments []*storage.Wal) error {
+	archiveDir := atlas.config.Wal.ArchiveDir
+	for _, wal := range segments {
+		// archived by an earlier attempt at a failed flush
+		if _, err := os.Stat(wal.Filename()); os.IsNotExist(err) {
+			continue
+		}
+
+		target := path.Join(archiveDir, path.Base(wal.Filename()))
+		if err := moveFile(wal.Filename(), target); err != nil {
+			return err
+		}
+	}
+	return pruneArchive(archiveDir, atlas.config.Wal.ArchiveRetention)
+}
+
+func pruneArchive(archiveDir string, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+
+	filenames, err := listWalFiles(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+
+		if time.Since(stat.ModTime()) < retention {
+			continue
+		}
+
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		logger.Info("Removed archived WAL %s past its retention", filename)
+	}
+	return nil
+}
+
+// Rebuilds the store from an LSM checkpoint by replaying the archived writes
+// made after it up to the target, and returns the last recovered sequence. The
+// checkpoint is either written by `Atlas.Checkpoint` or a copy of an LSM
+// directory. It must not run while an `Atlas` uses the directories of the
+// config.
+//
+// The recovery is staged in a copy of the checkpoint and nothing else changes
+// before it succeeds. The current LSM directory is then moved aside rather
+// than removed, the segments left in the WAL directory are archived, and the
+// archived writes past the target are moved into a subdirectory of the
+// archive, so that a later recovery does not mix them with the writes made
+// after this one.
+func RecoverToPoint(config AtlasConfig, checkpointDir string, target RecoveryTarget) (uint64, error) {
+	archiveDir := config.Wal.ArchiveDir
+	if archiveDir == "" {
+		return 0, errors.New("Failed recovering to point - WAL archiving is disabled")
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return 0, err
+	}
+
+	archivedFilenames, err := listWalFiles(archiveDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// live segments hold the newest writes, none of them is archived yet
+	liveFilenames, err := listWalFiles(config.Wal.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	stagingDir := config.Lsm.Dir + "-recovering"
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if _, err := os.Stat(path.Join(checkpointDir, checkpointFilename)); err == nil {
+		checkpointDir = path.Join(checkpointDir, checkpointLsmDir)
+	}
+
+	if err := copyDir(checkpointDir, stagingDir); err != nil {
+		return 0, err
+	}
+
+	lsmConfig := config.Lsm
+	lsmConfig.Dir = stagingDir
+	lsm, err := storage.InitializeLsm(lsmConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	checkpointSequence := lsm.LastSequence()
+	if target.Sequence != 0 && target.Sequence < checkpointSequence {
+		lsm.Close()
+		return 0, fmt.Errorf(
+			"Failed recovering to point - checkpoint at sequence %d is newer than the target %d",
+			checkpointSequence, target.Sequence,
+		)
+	}
+
+	filenames := append(archivedFilenames, liveFilenames...)
+	lastSequence, complete, err := replayArchive(lsm, filenames, config.Wal, target)
+	if err != nil {
+		lsm.Close()
+		return 0, err
+	}
+
+	if err := lsm.Close(); err != nil {
+		return 0, err
+	}
+
+	// the last write of the current LSM was archived as well, so running out
+	// of records before it means that segments were removed
+	if !complete && lastSequence < lastLsmSequence(config.Lsm) {
+		return 0, fmt.Errorf(
+			"Failed recovering to point - archive ends at sequence %d, before the last write",
+			lastSequence,
+		)
+	}
+
+	for _, filename := range liveFilenames {
+		if err := moveFile(filename, path.Join(archiveDir, path.Base(filename))); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := os.Stat(config.Lsm.Dir); err == nil {
+		previousDir := fmt.Sprintf("%s-before-recovery-%d", config.Lsm.Dir, time.Now().UnixMilli())
+		if err := os.Rename(config.Lsm.Dir, previousDir); err != nil {
+			return 0, err
+		}
+		logger.Info("Moved LSM directory %s to %s", config.Lsm.Dir, previousDir)
+	}
+
+	if err := os.Rename(stagingDir, config.Lsm.Dir); err != nil {
+		return 0, err
+	}
+
+	if err := discardArchivedWrites(archiveDir, lastSequence, config.Wal.RecoveryPolicy); err != nil {
+		return 0, err
+	}
+
+	logger.Info(
+		"Recovered from checkpoint at sequence %d to sequence %d",
+		checkpointSequence, lastSequence,
+	)
+	return lastSequence, nil
+}
+
+// Writes the logged records following the last sequence of the LSM into it,
+// stopping at the first record past the target, and reports whether it was
+// reached. Records are replayed whole, so a batch is either recovered entirely
+// or not at all.
+func replayArchive(
+	lsm *storage.Lsm,
+	filenames []string,
+	config storage.WalConfig,
+	target RecoveryTarget,
+) (uint64, bool, error) {
+	lastSequence := lsm.LastSequence()
+	memtable := storage.NewMemtable()
+	flush := func() error {
+		memtable.Freeze()
+		if err := lsm.Flush(memtable); err != nil {
+			return err
+		}
+		memtable = storage.NewMemtable()
+		return nil
+	}
+
+	for _, filename := range filenames {
+		records, err := readWalRecords(filename, config.RecoveryPolicy)
+		if err != nil {
+			return 0, false, err
+		}
+
+		for _, record := range records {
+			// logs written before sequences were assigned predate any
+			// checkpoint
+			if recordSequence(record) <= lastSequence {
+				continue
+			}
+
+			if !target.includes(record) {
+				return lastSequence, true, flush()
+			}
+
+			for _, entry := range record.Entries {
+				if entry.Sequence() != lastSequence+1 {
+					return 0, false, fmt.Errorf(
+						"Failed recovering to point - archive is missing sequences %d to %d",
+						lastSequence+1, entry.Sequence()-1,
+					)
+				}
+
+				if err := memtable.Put(entry); err != nil {
+					return 0, false, err
+				}
+				lastSequence = entry.Sequence()
+			}
+
+			if isMemtableFull(memtable, config) {
+				if err := flush(); err != nil {
+					return 0, false, err
+				}
+			}
+		}
+	}
+
+	complete := target.Sequence != 0 && lastSequence >= target.Sequence
+	return lastSequence, complete, flush()
+}
+
+// Last sequence of the LSM being replaced as recorded in its manifest, zero if
+// it has none or the manifest cannot be read.
+func lastLsmSequence(config storage.LsmConfig) uint64 {
+	sequence, err := storage.ReadManifestLastSequence(config.Dir)
+	if os.IsNotExist(err) {
+		return 0
+	}
+
+	if err != nil {
+		logger.Warn("Failed reading manifest of LSM %s to check the archive covers it: %v", config.Dir, err)
+		return 0
+	}
+	return sequence
+}
+
+// Moves the archived segments holding writes past the recovered sequence
+// into a subdirectory of the archive. A segment holding writes on both sides
+// is replaced by a copy with the recovered ones.
+func discardArchivedWrites(archiveDir string, lastSequence uint64, policy storage.WalRecoveryPolicy) error {
+	filenames, err := listWalFiles(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	discardDir := path.Join(archiveDir, fmt.Sprintf("discarded-%d", time.Now().UnixMilli()))
+	for _, filename := range filenames {
+		records, err := readWalRecords(filename, policy)
+		if err != nil {
+			return err
+		}
+
+		kept := 0
+		for kept < len(records) && recordSequence(records[kept]) <= lastSequence {
+			kept += 1
+		}
+
+		if kept == len(records) {
+			continue
+		}
+
+		if err := os.MkdirAll(discardDir, 0755); err != nil {
+			return err
+		}
+
+		if err := moveFile(filename, path.Join(discardDir, path.Base(filename))); err != nil {
+			return err
+		}
+
+		if kept > 0 {
+			if err := writeWalRecords(filename, records[:kept]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := os.Stat(discardDir); err == nil {
+		logger.Warn("Moved archived writes past sequence %d to %s", lastSequence, discardDir)
+	}
+	return nil
+}
+
+func readWalRecords(filename string, policy storage.WalRecoveryPolicy) ([]storage.WalRecord, error) {
+	wal, err := storage.RestoreWal(filename, policy)
+	if err != nil {
+		return nil, err
+	}
+	defer wal.Close()
+
+	return wal.Records()
+}
+
+func writeWalRecords(filename string, records []storage.WalRecord) error {
+	wal, err := storage.CreateWal(filename)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := wal.AppendRecord(record); err != nil {
+			wal.Close()
+			return err
+		}
+	}
+
+	if err := wal.Sync(); err != nil {
+		wal.Close()
+		return err
+	}
+	return wal.Close()
+}
+
+// Highest sequence of the record, zero for records of logs written before
+// sequences were assigned.
+func recordSequence(record storage.WalRecord) uint64 {
+	var sequence uint64
+	for _, entry := range record.Entries {
+		sequence = max(sequence, entry.Sequence())
+	}
+	return sequence
+}
+
+func (target RecoveryTarget) includes(record storage.WalRecord) bool {
+	if target.Sequence != 0 && recordSequence(record) > target.Sequence {
+		return false
+	}
+	return target.Time.IsZero() || record.Timestamp <= target.Time.UnixMilli()
+}
+
+func copyDir(sourceDir, targetDir string) error {
+	return filepath.WalkDir(sourceDir, func(source string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(sourceDir, source)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(targetDir, relative)
+		if dirEntry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return utils.CopyFile(source, target, 0644)
+	})
+}
+
+// Renames the file, or copies it when the target is on another file system.
+func moveFile(source, target string) error {
+	err := os.Rename(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := utils.CopyFile(source, target, 0644); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
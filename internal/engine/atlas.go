@@ -4,25 +4,167 @@ import (
 	"atlas/internal/common"
 	"atlas/internal/storage"
 	"atlas/pkg/logger"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type AtlasConfig struct {
 	Lsm storage.LsmConfig
 	Wal storage.WalConfig
+
+	// Capacity in bytes of the cache of decoded SSTable blocks. A zero value
+	// disables the cache.
+	BlockCacheSize uint64
+}
+
+type AtlasStats struct {
+	Filter     storage.FilterStats
+	BlockCache storage.BlockCacheStats
+	WalSync    WalSyncStats
+	// Outcome of the WAL replay on startup, summed over all replayed logs.
+	Recovery storage.WalRecoveryStats
+	// Last failure of a background flush or of a rotation of the memtable or
+	// the WAL, empty once a flush or rotation succeeds again. Such failures
+	// happen after the write which triggered them is committed, so they do
+	// not fail it.
+	BackgroundError string
+}
+
+// Latencies of the WAL syncs, in nanoseconds when encoded.
+type WalSyncStats struct {
+	Syncs        uint64
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+type WriteOptions struct {
+	// Syncs the WAL before acknowledging the write, whatever the sync mode.
+	Sync bool
 }
 
+// Atlas is safe for concurrent use.
+//
+// Reads do not block each other. Under a short read lock, a read takes the
+// sequence of the last visible write together with the current memtables and
+// pins the current version of the SSTables, the rest of it runs without locks.
+//
+// Writes are queued to a single writer goroutine, which assigns their
+// sequences, appends them to the active WAL segment and applies them to the
+// memtable in the order they were queued. A memtable is backed by one or more
+// segments, the writer starts a new one whenever the active segment grows too
+// large or too old. Once the memtable is full, or too many segments are live,
+// the writer seals it together with its segments and hands them over to the
+// flusher goroutine, which writes the memtable into the LSM, removes the
+// segments and runs the compactions. The writer waits for the flusher only
+// when the next memtable fills up before the previous one is flushed.
+//
+// A failed flush is retried until it succeeds, meanwhile the writer holds back
+// the writes which would need to rotate the memtable again.
+//
+// `Close` stops both goroutines once the queued writes are applied and the
+// pending flush is done.
 type Atlas struct {
-	wal *storage.Wal
+	// guards the memtables and the outcome of the background flushes
+	mutex     sync.RWMutex
+	flushDone *sync.Cond
+
+	// held by checkpoints, so that the flusher does not remove or archive the
+	// segments they copy
+	checkpointMutex sync.Mutex
+
+	// the active segment and the sealed ones backing each memtable, from the
+	// oldest to the newest, replaced under the mutex by the writer
+	wal               *storage.Wal
+	segments          []*storage.Wal
+	immutableSegments []*storage.Wal
+
 	lsm *storage.Lsm
 
-	cache  map[string]*common.Entry
-	config AtlasConfig
+	memtable  *storage.Memtable
+	immutable *storage.Memtable
+	// failure of the last attempt at flushing the immutable memtable, the
+	// flusher stops retrying it once `Close` is called
+	flushErr       error
+	flushAbandoned bool
+	backgroundErr  error
+
+	writes  chan *writeRequest
+	flushes chan flushRequest
+
+	// held for reading while queueing a write, so that `Close` does not close
+	// the queue under it
+	closeMutex  sync.RWMutex
+	closed      atomic.Bool
+	closing     chan struct{}
+	writerDone  chan struct{}
+	flusherDone chan struct{}
+
+	// sequence of the last write applied to the memtable, reads do not see
+	// the writes after it, so a batch becomes visible all at once
+	visibleSequence atomic.Uint64
+
+	syncStats syncCounters
+	// set by the WAL replay before the goroutines start
+	recovery storage.WalRecoveryStats
+
+	// owned by the writer goroutine
+	lastSequence uint64
+	config       AtlasConfig
+}
+
+type syncCounters struct {
+	syncs        atomic.Uint64
+	totalLatency atomic.Int64
+	maxLatency   atomic.Int64
 }
 
+type writeRequest struct {
+	entries []*common.Entry
+	// runs on the writer goroutine right before the entries are written, so
+	// no other write can come in between; an error cancels the write
+	check   func() error
+	options WriteOptions
+	done    chan error
+}
+
+type flushRequest struct {
+	segments []*storage.Wal
+	memtable *storage.Memtable
+}
+
+// State of the engine a read runs against: the memtables and the version of
+// the SSTables holding every write up to the last visible sequence.
+type readView struct {
+	sequence  uint64
+	memtable  *storage.Memtable
+	immutable *storage.Memtable
+	tables    *storage.PinnedVersion
+}
+
+// Written by `Close` once everything is flushed and removed on the next start,
+// so its absence at startup means the previous run did not shut down cleanly.
+const cleanShutdownFilename = "CLEAN_SHUTDOWN"
+
+var ErrClosed = errors.New("Atlas is closed")
+
+// Upper bound on the writes sharing a sync in `WalSyncGroup` mode, so that the
+// first of them is not held back for too long.
+const maxWriteGroup = 256
+
+// Longest period between checks of the age of the active segment.
+const maxSegmentAgeCheckPeriod = time.Second
+
+// Delays between the attempts at a failed flush, doubling up to the maximum.
+const (
+	flushRetryDelay    = 100 * time.Millisecond
+	maxFlushRetryDelay = 5 * time.Second
+)
+
 func NewAtlas(config AtlasConfig) (*Atlas, error) {
 	if err := os.MkdirAll(config.Wal.Dir, 0755); err != nil {
 		logger.Error("Failed creating WAL directory: %v", err)
@@ -34,65 +176,660 @@ func NewAtlas(config AtlasConfig) (*Atlas, error) {
 		return nil, err
 	}
 
-	walFilename := buildWalFilename(config)
-	wal, err := storage.CreateWal(walFilename)
+	if config.Wal.ArchiveDir != "" {
+		if err := os.MkdirAll(config.Wal.ArchiveDir, 0755); err != nil {
+			logger.Error("Failed creating WAL archive directory: %v", err)
+			return nil, err
+		}
+	}
+
+	lsmConfig := config.Lsm
+	lsmConfig.BlockCache = storage.NewBlockCache(config.BlockCacheSize)
+	lsm, err := storage.InitializeLsm(lsmConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	lsm, err := storage.InitializeLsm(config.Lsm)
-	if err != nil {
+	atlas := &Atlas{
+		wal:          nil,
+		lsm:          lsm,
+		memtable:     storage.NewMemtable(),
+		immutable:    nil,
+		writes:       make(chan *writeRequest),
+		flushes:      make(chan flushRequest, 1),
+		closing:      make(chan struct{}),
+		writerDone:   make(chan struct{}),
+		flusherDone:  make(chan struct{}),
+		lastSequence: lsm.LastSequence(),
+		config:       config,
+	}
+	atlas.flushDone = sync.NewCond(&atlas.mutex)
+
+	if err := atlas.checkCleanShutdown(); err != nil {
 		return nil, err
 	}
 
-	return &Atlas{
-		wal:    wal,
-		lsm:    lsm,
-		cache:  make(map[string]*common.Entry),
-		config: config,
-	}, nil
+	if err := atlas.restoreWals(); err != nil {
+		return nil, err
+	}
+
+	if atlas.wal == nil {
+		atlas.wal, err = atlas.createWal()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	atlas.visibleSequence.Store(atlas.lastSequence)
+	go atlas.runWriter()
+	go atlas.runFlusher()
+	return atlas, nil
+}
+
+// Replays every WAL segment left over from a previous run, oldest first, so
+// that later writes shadow earlier ones. The newest segment is kept open as
+// the active one unless it is due for rotation, the others back the memtable,
+// which is flushed into the LSM as soon as it is full or too many segments
+// are live. Runs before the writer and flusher goroutines are started.
+func (atlas *Atlas) restoreWals() error {
+	walFilenames, err := listWalFiles(atlas.config.Wal.Dir)
+	if err != nil {
+		return err
+	}
+
+	for idx, walFilename := range walFilenames {
+		wal, err := storage.RestoreWal(walFilename, atlas.config.Wal.RecoveryPolicy)
+		if err != nil {
+			return err
+		}
+
+		recovery := wal.Recovery()
+		atlas.recovery.Records += recovery.Records
+		atlas.recovery.Entries += recovery.Entries
+		atlas.recovery.SkippedRecords += recovery.SkippedRecords
+		atlas.recovery.TruncatedBytes += recovery.TruncatedBytes
+
+		entries, err := wal.Entries()
+		if err != nil {
+			wal.Close()
+			return err
+		}
+
+		for _, entry := range entries {
+			// entries migrated from logs without sequences are newer than
+			// anything already in the LSM
+			if entry.Sequence() == 0 {
+				atlas.lastSequence += 1
+				entry.SetSequence(atlas.lastSequence)
+			}
+			atlas.lastSequence = max(atlas.lastSequence, entry.Sequence())
+
+			if err := atlas.memtable.Put(entry); err != nil {
+				wal.Close()
+				return err
+			}
+		}
+
+		logger.Info(
+			"Replayed %d records with %d entries from WAL %s",
+			recovery.Records, len(entries), walFilename,
+		)
+		if idx == len(walFilenames)-1 && !wal.NeedsRotation(atlas.config.Wal) && !isMemtableFull(atlas.memtable, atlas.config.Wal) {
+			atlas.wal = wal
+			break
+		}
+
+		if err := wal.Close(); err != nil {
+			return err
+		}
+		atlas.segments = append(atlas.segments, wal)
+
+		if isMemtableFull(atlas.memtable, atlas.config.Wal) || atlas.exceedsMaxLogs(0) {
+			atlas.memtable.Freeze()
+			if err := atlas.flushMemtable(atlas.segments, atlas.memtable); err != nil {
+				return err
+			}
+			atlas.memtable = storage.NewMemtable()
+			atlas.segments = nil
+		}
+	}
+	return nil
 }
 
 func (atlas *Atlas) Get(key string) (*common.Entry, bool, error) {
-	entry, cached := atlas.cache[key]
-	if cached {
-		return filterResponse(entry, nil)
+	if atlas.closed.Load() {
+		return nil, false, ErrClosed
+	}
+	view, err := atlas.acquireReadView()
+	if err != nil {
+		return nil, false, err
 	}
+	defer view.release()
 
-	entry, contained, err := atlas.lsm.Get(key)
+	entry, _, err := view.getVersion(key, view.sequence)
+	return filterResponse(entry, err)
+}
+
+// Takes the view while the memtables cannot be rotated. Every memtable frozen
+// before was applied up to the visible sequence, so the pinned SSTables hold no
+// version newer than it, and no flush or compaction can have dropped a version
+// visible at it in favour of a newer one. Unlike a snapshot, the view does not
+// need the versions to be kept by later compactions, which is why plain reads
+// do not go through the snapshot list.
+func (atlas *Atlas) acquireReadView() (*readView, error) {
+	atlas.mutex.RLock()
+	defer atlas.mutex.RUnlock()
+
+	tables, err := atlas.lsm.PinVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	return &readView{
+		sequence:  atlas.visibleSequence.Load(),
+		memtable:  atlas.memtable,
+		immutable: atlas.immutable,
+		tables:    tables,
+	}, nil
+}
+
+// Returns the newest live version of the key visible at the sequence, which
+// has to be pinned by a snapshot.
+func (atlas *Atlas) get(key string, sequence uint64) (*common.Entry, bool, error) {
+	entry, _, err := atlas.getVersion(key, sequence)
+	return filterResponse(entry, err)
+}
+
+// Returns the newest version of the key visible at the sequence, including
+// tombstones. The sequence has to be pinned by a snapshot, or the read has to
+// run on the writer goroutine, unless it is `common.MaxSequence`.
+func (atlas *Atlas) getVersion(key string, sequence uint64) (*common.Entry, bool, error) {
+	view, err := atlas.acquireReadView()
 	if err != nil {
 		return nil, false, err
 	}
+	defer view.release()
+	return view.getVersion(key, sequence)
+}
+
+func (view *readView) getVersion(key string, sequence uint64) (*common.Entry, bool, error) {
+	if entry, contained := view.memtable.Get(key, sequence); contained {
+		return entry, true, nil
+	}
+
+	if view.immutable != nil {
+		if entry, contained := view.immutable.Get(key, sequence); contained {
+			return entry, true, nil
+		}
+	}
+	return view.tables.Get(key, sequence)
+}
 
-	if contained {
-		atlas.cache[key] = entry
-		return filterResponse(entry, nil)
+func (view *readView) release() {
+	view.tables.Release()
+}
+
+func (atlas *Atlas) Stats() AtlasStats {
+	atlas.mutex.RLock()
+	backgroundErr := atlas.backgroundErr
+	atlas.mutex.RUnlock()
+
+	stats := AtlasStats{
+		Filter:     atlas.lsm.FilterStats(),
+		BlockCache: atlas.lsm.BlockCacheStats(),
+		WalSync: WalSyncStats{
+			Syncs:        atlas.syncStats.syncs.Load(),
+			TotalLatency: time.Duration(atlas.syncStats.totalLatency.Load()),
+			MaxLatency:   time.Duration(atlas.syncStats.maxLatency.Load()),
+		},
+		Recovery: atlas.recovery,
+	}
+	if backgroundErr != nil {
+		stats.BackgroundError = backgroundErr.Error()
 	}
-	return nil, false, nil
+	return stats
 }
 
 func (atlas *Atlas) Insert(key, value string) error {
-	return atlas.updateEntry(common.NewEntry(key, value))
+	return atlas.write([]*common.Entry{common.NewEntry(key, value)}, WriteOptions{})
+}
+
+// Writes the value to expire once the TTL elapses. Expired keys read as
+// deleted and are dropped by compactions.
+func (atlas *Atlas) InsertWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("Failed inserting entry - TTL has to be positive")
+	}
+	return atlas.write([]*common.Entry{common.NewEntryWithTTL(key, value, ttl)}, WriteOptions{})
 }
 
 func (atlas *Atlas) Delete(key string) error {
-	return atlas.updateEntry(common.NewEmptyEntry(key))
+	return atlas.write([]*common.Entry{common.NewEmptyEntry(key)}, WriteOptions{})
 }
 
-func (atlas *Atlas) updateEntry(entry *common.Entry) error {
-	err := atlas.wal.Append(entry)
+// Queues the entries to the writer goroutine and waits until they are written
+// to the WAL and the memtable, and synced as the sync mode or the options ask.
+func (atlas *Atlas) write(entries []*common.Entry, options WriteOptions) error {
+	return atlas.writeChecked(entries, nil, options)
+}
+
+// Same as `write`, but the entries are written only if `check` succeeds on
+// the writer goroutine, which sees every write queued before them.
+func (atlas *Atlas) writeChecked(
+	entries []*common.Entry,
+	check func() error,
+	options WriteOptions,
+) error {
+	request := &writeRequest{
+		entries: entries,
+		check:   check,
+		options: options,
+		done:    make(chan error, 1),
+	}
+
+	atlas.closeMutex.RLock()
+	if atlas.closed.Load() {
+		atlas.closeMutex.RUnlock()
+		return ErrClosed
+	}
+	atlas.writes <- request
+	atlas.closeMutex.RUnlock()
+	return <-request.done
+}
+
+// Besides applying the writes, the writer syncs the WAL, which it owns. In
+// `WalSyncInterval` mode it does so on every tick of the interval, and it
+// rotates the active segment once it grows older than `SegmentMaxAge`.
+func (atlas *Atlas) runWriter() {
+	defer close(atlas.writerDone)
+	// the writer is the only one handing memtables over to the flusher
+	defer close(atlas.flushes)
+
+	var ticks <-chan time.Time = nil
+	if atlas.config.Wal.SyncMode == storage.WalSyncInterval {
+		ticker := time.NewTicker(atlas.config.Wal.SyncPeriod())
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	var ageTicks <-chan time.Time = nil
+	if atlas.config.Wal.SegmentMaxAge > 0 {
+		ticker := time.NewTicker(min(atlas.config.Wal.SegmentMaxAge, maxSegmentAgeCheckPeriod))
+		defer ticker.Stop()
+		ageTicks = ticker.C
+	}
+
+	for {
+		select {
+		case request, open := <-atlas.writes:
+			if !open {
+				return
+			}
+			atlas.commitWrites(atlas.collectWrites(request))
+		case <-ticks:
+			if err := atlas.syncWal(atlas.wal); err != nil {
+				logger.Error("Failed syncing WAL %s: %v", atlas.wal.Filename(), err)
+			}
+		case <-ageTicks:
+			if !atlas.wal.NeedsRotation(atlas.config.Wal) {
+				continue
+			}
+
+			atlas.reportRotation(atlas.rotateSegment())
+		}
+	}
+}
+
+// In `WalSyncGroup` mode takes the writes queued behind the request as well,
+// so that a single sync covers all of them.
+func (atlas *Atlas) collectWrites(request *writeRequest) []*writeRequest {
+	requests := []*writeRequest{request}
+	if atlas.config.Wal.SyncMode != storage.WalSyncGroup {
+		return requests
+	}
+
+	for len(requests) < maxWriteGroup {
+		select {
+		case request, open := <-atlas.writes:
+			if !open {
+				return requests
+			}
+			requests = append(requests, request)
+		default:
+			return requests
+		}
+	}
+	return requests
+}
+
+// Applies the writes one by one and syncs the WAL once after all of them, if
+// the sync mode or one of the writes asks for it. None of them is acknowledged
+// before the sync, and a failed sync fails all of them.
+func (atlas *Atlas) commitWrites(requests []*writeRequest) {
+	syncMode := atlas.config.Wal.SyncMode
+	needsSync := false
+	errs := make([]error, len(requests))
+	for idx, request := range requests {
+		if request.check != nil {
+			if errs[idx] = request.check(); errs[idx] != nil {
+				continue
+			}
+		}
+
+		errs[idx] = atlas.applyWrite(request.entries)
+		if request.options.Sync || syncMode == storage.WalSyncAlways || syncMode == storage.WalSyncGroup {
+			needsSync = true
+		}
+	}
+
+	if needsSync {
+		if err := atlas.syncWal(atlas.wal); err != nil {
+			for idx := range errs {
+				if errs[idx] == nil {
+					errs[idx] = err
+				}
+			}
+		}
+	}
+
+	for idx, request := range requests {
+		request.done <- errs[idx]
+	}
+}
+
+func (atlas *Atlas) syncWal(wal *storage.Wal) error {
+	start := time.Now()
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+
+	latency := int64(time.Since(start))
+	atlas.syncStats.syncs.Add(1)
+	atlas.syncStats.totalLatency.Add(latency)
+	for {
+		maxLatency := atlas.syncStats.maxLatency.Load()
+		if latency <= maxLatency || atlas.syncStats.maxLatency.CompareAndSwap(maxLatency, latency) {
+			return nil
+		}
+	}
+}
+
+// Runs on the writer goroutine, the only one replacing the active WAL and
+// memtable, which is why they are read without locking.
+func (atlas *Atlas) applyWrite(entries []*common.Entry) error {
+	for idx, entry := range entries {
+		entry.SetSequence(atlas.lastSequence + uint64(idx) + 1)
+	}
+
+	// the sequences are taken only once the write is in the WAL, so that a
+	// failed append does not leave a gap in them
+	if err := atlas.wal.AppendBatch(entries); err != nil {
+		return err
+	}
+	atlas.lastSequence += uint64(len(entries))
+
+	for _, entry := range entries {
+		if err := atlas.memtable.Put(entry); err != nil {
+			return err
+		}
+	}
+	atlas.visibleSequence.Store(atlas.lastSequence)
+
+	// the write is committed, a failed rotation is reported on its own and
+	// tried again by the next write
+	if isMemtableFull(atlas.memtable, atlas.config.Wal) {
+		atlas.reportRotation(atlas.rotateMemtable())
+	} else if atlas.wal.NeedsRotation(atlas.config.Wal) {
+		atlas.reportRotation(atlas.rotateSegment())
+	}
+	return nil
+}
+
+func (atlas *Atlas) reportRotation(err error) {
+	if err != nil {
+		logger.Error("Failed rotating the memtable or the WAL: %v", err)
+	}
+
+	atlas.mutex.Lock()
+	if err == nil {
+		// a flush may still be failing
+		err = atlas.flushErr
+	}
+	atlas.backgroundErr = err
+	atlas.mutex.Unlock()
+}
+
+func isMemtableFull(memtable *storage.Memtable, config storage.WalConfig) bool {
+	if config.MaxEntries > 0 && memtable.Count() >= config.MaxEntries {
+		return true
+	}
+	return config.MaxSize > 0 && memtable.Size() >= config.MaxSize
+}
+
+// Seals the memtable together with its segments, opens new ones for subsequent
+// writes and hands the sealed ones over to the flusher. Only one memtable is
+// flushed at a time, so this waits for the previous flush first, including
+// its retries.
+func (atlas *Atlas) rotateMemtable() error {
+	atlas.mutex.Lock()
+	for atlas.immutable != nil && !atlas.flushAbandoned {
+		atlas.flushDone.Wait()
+	}
+	var err error
+	if atlas.flushAbandoned {
+		err = fmt.Errorf("Failed flushing the previous memtable: %w", atlas.flushErr)
+	}
+	atlas.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	wal, err := atlas.createWal()
+	if err != nil {
+		return err
+	}
+
+	sealedWal, sealedMemtable := atlas.wal, atlas.memtable
+	if err := atlas.sealWal(sealedWal); err != nil {
+		atlas.discardWal(wal)
+		return err
+	}
+
+	sealedSegments := append(atlas.segments, sealedWal)
+	sealedMemtable.Freeze()
+
+	atlas.mutex.Lock()
+	atlas.wal = wal
+	atlas.segments = nil
+	atlas.immutableSegments = sealedSegments
+	atlas.immutable = sealedMemtable
+	atlas.memtable = storage.NewMemtable()
+	atlas.mutex.Unlock()
+
+	atlas.flushes <- flushRequest{segments: sealedSegments, memtable: sealedMemtable}
+	return nil
+}
+
+// The frozen memtable stays readable until its SSTable is installed in the
+// LSM. A failed flush keeps it readable and is retried with a growing delay
+// until it succeeds, or until `Close` is called, which then keeps the segments
+// backing it for the next start to replay.
+func (atlas *Atlas) runFlusher() {
+	defer close(atlas.flusherDone)
+
+	for request := range atlas.flushes {
+		delay := flushRetryDelay
+		for {
+			err := atlas.flushMemtable(request.segments, request.memtable)
+
+			atlas.mutex.Lock()
+			atlas.flushErr = err
+			atlas.backgroundErr = err
+			if err == nil {
+				atlas.immutable = nil
+				atlas.immutableSegments = nil
+			}
+			atlas.flushDone.Broadcast()
+			atlas.mutex.Unlock()
+
+			if err == nil || !atlas.waitFlushRetry(delay) {
+				break
+			}
+			delay = min(2*delay, maxFlushRetryDelay)
+		}
+	}
+}
+
+// Returns false instead once `Close` is called, after marking the failed
+// flush as abandoned.
+func (atlas *Atlas) waitFlushRetry(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-atlas.closing:
+		atlas.mutex.Lock()
+		atlas.flushAbandoned = true
+		atlas.flushDone.Broadcast()
+		atlas.mutex.Unlock()
+		return false
+	}
+}
+
+// Writes the frozen memtable into the LSM. The segments backing it, which are
+// already sealed, are deleted only after the SSTable has been synced to disk.
+//
+// Safe to call again after a failure. A memtable is installed in the LSM at
+// most once, so that a failed compaction does not flush it a second time, and
+// the segments removed or archived already are skipped.
+func (atlas *Atlas) flushMemtable(segments []*storage.Wal, memtable *storage.Memtable) error {
+	// memtables are flushed in the order of their sequences
+	if memtable.Count() > 0 && atlas.lsm.LastSequence() < memtable.LastSequence() {
+		if err := atlas.lsm.Flush(memtable); err != nil {
+			logger.Error("Failed flushing memtable into the LSM: %v", err)
+			return err
+		}
+	} else if err := atlas.lsm.Compact(); err != nil {
+		logger.Error("Failed compacting the LSM: %v", err)
+		return err
+	}
+
+	atlas.checkpointMutex.Lock()
+	defer atlas.checkpointMutex.Unlock()
+
+	if atlas.config.Wal.ArchiveDir != "" {
+		if err := atlas.archiveSegments(segments); err != nil {
+			logger.Error("Failed archiving WAL segments: %v", err)
+			return err
+		}
+	} else {
+		for _, wal := range segments {
+			if err := os.Remove(wal.Filename()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	logger.Info("Flushed memtable backed by %d WAL segments into the LSM", len(segments))
+	return nil
+}
+
+// Stops accepting writes, applies the queued ones and waits for the background
+// flush and compactions. The active memtable is then flushed into the LSM, so
+// that the next start has no WAL to replay, and every file is closed. Reads
+// and writes after `Close` fail with `ErrClosed`. Reads and iterators still
+// running keep working, the SSTables they use are closed once they are done.
+//
+// If a background flush failed, the active WAL is synced and kept for replay
+// instead, and the error is returned.
+func (atlas *Atlas) Close() error {
+	if atlas.closed.Swap(true) {
+		return ErrClosed
+	}
+	// a flush being retried holds up the writer and the writes queued to it,
+	// so it has to give up before the queue can be closed
+	close(atlas.closing)
+
+	atlas.closeMutex.Lock()
+	close(atlas.writes)
+	atlas.closeMutex.Unlock()
+
+	<-atlas.writerDone
+	<-atlas.flusherDone
+
+	atlas.mutex.RLock()
+	flushErr := atlas.flushErr
+	atlas.mutex.RUnlock()
+
+	var errs []error
+	if flushErr != nil {
+		// the failed memtable has to be replayed before the active one, which
+		// therefore cannot go into the LSM ahead of it
+		errs = append(errs, flushErr)
+		if err := atlas.sealWal(atlas.wal); err != nil {
+			errs = append(errs, err)
+		}
+	} else if err := atlas.sealWal(atlas.wal); err != nil {
+		errs = append(errs, err)
+	} else {
+		atlas.memtable.Freeze()
+		segments := append(atlas.segments, atlas.wal)
+		if err := atlas.flushMemtable(segments, atlas.memtable); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := atlas.lsm.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if err := atlas.writeCleanShutdownMarker(); err != nil {
+		return err
+	}
+
+	logger.Info("Closed Atlas")
+	return nil
+}
+
+// Consumes the marker of the previous run.
+func (atlas *Atlas) checkCleanShutdown() error {
+	filename := path.Join(atlas.config.Wal.Dir, cleanShutdownFilename)
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		walFilenames, err := listWalFiles(atlas.config.Wal.Dir)
+		if err != nil {
+			return err
+		}
+
+		if len(walFilenames) > 0 {
+			logger.Warn("Previous run did not shut down cleanly, recovering from the WAL")
+		}
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
 
-	atlas.cache[entry.Key()] = entry
+	logger.Info("Previous run shut down cleanly")
 	return nil
 }
 
-func buildWalFilename(config AtlasConfig) string {
-	timestamp := time.Now().UnixMilli()
-	filename := fmt.Sprintf("%d.wal", timestamp)
-	return path.Join(config.Wal.Dir, filename)
+func (atlas *Atlas) writeCleanShutdownMarker() error {
+	file, err := os.Create(path.Join(atlas.config.Wal.Dir, cleanShutdownFilename))
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
 func filterResponse(entry *common.Entry, err error) (*common.Entry, bool, error) {
@@ -100,7 +837,7 @@ func filterResponse(entry *common.Entry, err error) (*common.Entry, bool, error)
 		return nil, false, err
 	}
 
-	if entry == nil || entry.IsDead() {
+	if entry == nil || !entry.IsLive(time.Now().UnixMilli()) {
 		return nil, false, nil
 	}
 	return entry, true, nil
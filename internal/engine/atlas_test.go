@@ -0,0 +1,478 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testAtlasConfig(dir string) AtlasConfig {
+	return AtlasConfig{
+		Lsm: storage.LsmConfig{
+			Dir:       filepath.Join(dir, "lsm"),
+			BlockSize: 256,
+			Levels: []storage.LsmLevelConfig{
+				{MaxFileSize: 2048, MaxTables: 2},
+				{MaxFileSize: 4096, MaxTables: 4},
+				{MaxFileSize: 8192},
+			},
+			BloomBitsPerKey:       10,
+			ObsoleteSweepInterval: 10 * time.Millisecond,
+		},
+		Wal: storage.WalConfig{
+			Dir:         filepath.Join(dir, "wal"),
+			MaxEntries:  50,
+			SegmentSize: 1024,
+		},
+		BlockCacheSize: 64 * 1024,
+	}
+}
+
+func openTestAtlas(t *testing.T, config AtlasConfig) *Atlas {
+	t.Helper()
+
+	atlas, err := NewAtlas(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return atlas
+}
+
+func expectTestValue(t *testing.T, atlas *Atlas, key, expected string) {
+	t.Helper()
+
+	entry, found, err := atlas.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := ""
+	if found {
+		value, _ = entry.Value()
+	}
+
+	if value != expected {
+		t.Fatalf("got %q for %s, expected %q", value, key, expected)
+	}
+}
+
+// Writers keep overwriting their own keys with increasing counters while the
+// memtable is flushed and the levels compacted. Readers check that no key goes
+// back to an older counter, that scans are sorted and that reads through a
+// snapshot stay the same whatever is written after it.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	const writers = 4
+	const keysPerWriter = 25
+	const rounds = 20
+
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	key := func(writer, idx int) string {
+		return fmt.Sprintf("w%d-key%03d", writer, idx)
+	}
+
+	counter := func(t *testing.T, value string) int {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			t.Errorf("invalid value %q", value)
+		}
+		return count
+	}
+
+	var done atomic.Bool
+	var writersGroup, readersGroup sync.WaitGroup
+	for writer := range writers {
+		writersGroup.Add(1)
+		go func() {
+			defer writersGroup.Done()
+			for round := 1; round <= rounds; round++ {
+				for idx := range keysPerWriter {
+					var err error
+					if idx%10 == 9 && round%5 == 0 {
+						err = atlas.Delete(key(writer, idx))
+					} else {
+						err = atlas.Insert(key(writer, idx), strconv.Itoa(round))
+					}
+
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	readersGroup.Add(1)
+	go func() {
+		defer readersGroup.Done()
+		seen := make(map[string]int)
+		for !done.Load() {
+			for writer := range writers {
+				for idx := range keysPerWriter {
+					entry, found, err := atlas.Get(key(writer, idx))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					if !found {
+						continue
+					}
+
+					value, _ := entry.Value()
+					count := counter(t, value)
+					if count < seen[entry.Key()] {
+						t.Errorf("%s went back from %d to %d", entry.Key(), seen[entry.Key()], count)
+						return
+					}
+					seen[entry.Key()] = count
+				}
+			}
+		}
+	}()
+
+	readersGroup.Add(1)
+	go func() {
+		defer readersGroup.Done()
+		for !done.Load() {
+			entries, err := atlas.Scan("", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for idx := 1; idx < len(entries); idx++ {
+				if entries[idx-1].Key() >= entries[idx].Key() {
+					t.Errorf("scan returned %s before %s", entries[idx-1].Key(), entries[idx].Key())
+					return
+				}
+			}
+		}
+	}()
+
+	readersGroup.Add(1)
+	go func() {
+		defer readersGroup.Done()
+		for !done.Load() {
+			snapshot := atlas.Snapshot()
+			before := make(map[string]string)
+			for writer := range writers {
+				for idx := range keysPerWriter {
+					entry, found, err := snapshot.Get(key(writer, idx))
+					if err != nil {
+						t.Error(err)
+						snapshot.Release()
+						return
+					}
+
+					if found {
+						before[entry.Key()], _ = entry.Value()
+					}
+				}
+			}
+
+			iter, err := atlas.NewIterator(IteratorOptions{Snapshot: snapshot})
+			if err != nil {
+				t.Error(err)
+				snapshot.Release()
+				return
+			}
+
+			count := 0
+			for ; iter.Valid(); iter.Next() {
+				value, _ := iter.Entry().Value()
+				if before[iter.Entry().Key()] != value {
+					t.Errorf("snapshot read %q for %s, then %q", before[iter.Entry().Key()], iter.Entry().Key(), value)
+				}
+				count += 1
+			}
+
+			if err := iter.Err(); err != nil {
+				t.Error(err)
+			}
+			iter.Close()
+
+			if count != len(before) {
+				t.Errorf("snapshot read %d keys, then iterated over %d", len(before), count)
+			}
+			snapshot.Release()
+		}
+	}()
+
+	writersGroup.Wait()
+	done.Store(true)
+	readersGroup.Wait()
+
+	if t.Failed() {
+		return
+	}
+
+	for writer := range writers {
+		for idx := range keysPerWriter {
+			expected := strconv.Itoa(rounds)
+			if idx%10 == 9 {
+				expected = ""
+			}
+			expectTestValue(t, atlas, key(writer, idx), expected)
+		}
+	}
+}
+
+func TestWritesSurviveFailedFlushes(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.SegmentSize = 0
+	config.Wal.MaxEntries = 5
+	atlas := openTestAtlas(t, config)
+
+	// flushes fail while the directory of the first level is missing
+	levelDir := filepath.Join(config.Lsm.Dir, "0")
+	if err := os.Rename(levelDir, levelDir+"-moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := range 8 {
+		if err := atlas.Insert(fmt.Sprintf("key%02d", idx), "value"); err != nil {
+			t.Fatalf("write failed along with the flush: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atlas.Stats().BackgroundError == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("failed flush was not reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.Rename(levelDir+"-moved", levelDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for atlas.Stats().BackgroundError != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("failed flush was not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for idx := 8; idx < 12; idx++ {
+		if err := atlas.Insert(fmt.Sprintf("key%02d", idx), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+
+	entries, err := atlas.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 12 {
+		t.Fatalf("reopened store holds %d keys, expected 12", len(entries))
+	}
+}
+
+func TestFlushAbandonedOnCloseIsReplayed(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.SegmentSize = 0
+	config.Wal.MaxEntries = 5
+	atlas := openTestAtlas(t, config)
+
+	levelDir := filepath.Join(config.Lsm.Dir, "0")
+	if err := os.Rename(levelDir, levelDir+"-moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := range 8 {
+		if err := atlas.Insert(fmt.Sprintf("key%02d", idx), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := atlas.Close(); err == nil {
+		t.Fatal("closing with a failed flush succeeded")
+	}
+
+	if err := os.Rename(levelDir+"-moved", levelDir); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+
+	entries, err := atlas.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 8 {
+		t.Fatalf("reopened store holds %d keys, expected 8", len(entries))
+	}
+}
+
+// The store is copied while it runs, as a crash would leave it, with the
+// writes in the WAL only.
+func TestUnflushedWritesAreReplayedOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	config := testAtlasConfig(dir)
+	config.Wal.MaxEntries = 1000
+	atlas := openTestAtlas(t, config)
+	defer atlas.Close()
+
+	for idx := range 20 {
+		if err := atlas.Insert(fmt.Sprintf("key%02d", idx), strconv.Itoa(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := atlas.Delete("key05"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put("key00", "overwritten")
+	if err := atlas.WriteWithOptions(batch, WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	crashedConfig := testAtlasConfig(filepath.Join(dir, "crashed"))
+	if err := copyDir(config.Wal.Dir, crashedConfig.Wal.Dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyDir(config.Lsm.Dir, crashedConfig.Lsm.Dir); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := openTestAtlas(t, crashedConfig)
+	defer crashed.Close()
+
+	if recovery := crashed.Stats().Recovery; recovery.Entries != 22 {
+		t.Fatalf("replayed %d entries, expected 22", recovery.Entries)
+	}
+
+	expectTestValue(t, crashed, "key00", "overwritten")
+	expectTestValue(t, crashed, "key05", "")
+	for idx := 6; idx < 20; idx++ {
+		expectTestValue(t, crashed, fmt.Sprintf("key%02d", idx), strconv.Itoa(idx))
+	}
+
+	// new writes follow the replayed ones
+	version, err := crashed.PutIfAbsent("key05", "rewritten")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 23 {
+		t.Fatalf("first write after the replay has sequence %d", version)
+	}
+}
+
+func TestFullMemtableIsFlushedAndItsWalRemoved(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.SegmentSize = 0
+	config.Wal.MaxEntries = 10
+	atlas := openTestAtlas(t, config)
+	defer atlas.Close()
+
+	for idx := range 35 {
+		if err := atlas.Insert(fmt.Sprintf("key%02d", idx), strconv.Itoa(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the segment of the active memtable is left once the flushes are
+	// done
+	deadline := time.Now().Add(5 * time.Second)
+	for atlas.lsm.LastSequence() < 30 || len(atlas.WalSegments()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("LSM holds writes up to %d after 3 full memtables", atlas.lsm.LastSequence())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	segments := atlas.WalSegments()
+	if len(segments) != 1 || segments[0].FirstSequence != 31 || segments[0].Entries != 5 {
+		t.Fatalf("live segments %+v", segments)
+	}
+
+	walFiles, err := listWalFiles(config.Wal.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(walFiles) != 1 {
+		t.Fatalf("flushed segments were left in %v", walFiles)
+	}
+
+	for idx := range 35 {
+		expectTestValue(t, atlas, fmt.Sprintf("key%02d", idx), strconv.Itoa(idx))
+	}
+}
+
+func TestNewestWriteWinsAcrossRestarts(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	atlas := openTestAtlas(t, config)
+
+	first, err := atlas.PutIfAbsent("a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, _, err := atlas.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each close flushes the memtable into a new table, which holds the only
+	// record of the sequences and timestamps
+	for round := 2; round <= 4; round++ {
+		if err := atlas.Close(); err != nil {
+			t.Fatal(err)
+		}
+		atlas = openTestAtlas(t, config)
+
+		if round == 2 {
+			entry, _, err := atlas.Get("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.Sequence() != first || entry.Timestamp() != written.Timestamp() {
+				t.Fatalf("reopened entry has sequence %d and timestamp %d, written with %d and %d",
+					entry.Sequence(), entry.Timestamp(), first, written.Timestamp())
+			}
+		}
+
+		version, err := atlas.CompareAndSwap("a", strconv.Itoa(round-1), strconv.Itoa(round))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if version != uint64(round) {
+			t.Fatalf("write after %d restarts has sequence %d", round-1, version)
+		}
+	}
+
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+	expectTestValue(t, atlas, "a", "4")
+}
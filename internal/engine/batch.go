@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"atlas/internal/common"
+	"errors"
+)
+
+// Group of writes applied atomically by `Atlas.Write`. The batch is written to
+// the WAL as a single record, so after a crash either all of its writes are
+// recovered or none of them. Later writes to the same key in the batch win.
+//
+// A batch is not safe for concurrent use, but it may be reused once written.
+type WriteBatch struct {
+	operations []batchOperation
+}
+
+type batchOperation struct {
+	key      string
+	value    string
+	isDelete bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{operations: nil}
+}
+
+func (batch *WriteBatch) Put(key, value string) {
+	batch.operations = append(batch.operations, batchOperation{key: key, value: value})
+}
+
+func (batch *WriteBatch) Delete(key string) {
+	batch.operations = append(batch.operations, batchOperation{key: key, isDelete: true})
+}
+
+func (batch *WriteBatch) Clear() {
+	batch.operations = batch.operations[:0]
+}
+
+func (batch *WriteBatch) Len() int {
+	return len(batch.operations)
+}
+
+func (atlas *Atlas) Write(batch *WriteBatch) error {
+	return atlas.WriteWithOptions(batch, WriteOptions{})
+}
+
+func (atlas *Atlas) WriteWithOptions(batch *WriteBatch, options WriteOptions) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	entries, err := batch.entries()
+	if err != nil {
+		return err
+	}
+	return atlas.write(entries, options)
+}
+
+// Fresh entries for the operations, the writer assigns their sequences.
+func (batch *WriteBatch) entries() ([]*common.Entry, error) {
+	entries := make([]*common.Entry, 0, batch.Len())
+	for _, operation := range batch.operations {
+		if operation.key == "" {
+			return nil, errors.New("Failed writing batch - empty key")
+		}
+
+		if operation.isDelete {
+			entries = append(entries, common.NewEmptyEntry(operation.key))
+		} else {
+			entries = append(entries, common.NewEntry(operation.key, operation.value))
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatchAppliesAllOperations(t *testing.T) {
+	dir := t.TempDir()
+	config := testAtlasConfig(dir)
+	atlas := openTestAtlas(t, config)
+	defer atlas.Close()
+
+	if err := atlas.Insert("deleted", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put("a", "1")
+	batch.Put("b", "1")
+	batch.Delete("deleted")
+	batch.Put("a", "2")
+	if err := atlas.WriteWithOptions(batch, WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTestValue(t, atlas, "a", "2")
+	expectTestValue(t, atlas, "b", "1")
+	expectTestValue(t, atlas, "deleted", "")
+
+	// the batch is a single record of the WAL
+	crashedConfig := testAtlasConfig(filepath.Join(dir, "crashed"))
+	if err := copyDir(config.Wal.Dir, crashedConfig.Wal.Dir); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := openTestAtlas(t, crashedConfig)
+	defer crashed.Close()
+
+	if recovery := crashed.Stats().Recovery; recovery.Records != 2 || recovery.Entries != 5 {
+		t.Fatalf("replayed %d records of %d entries", recovery.Records, recovery.Entries)
+	}
+	expectTestValue(t, crashed, "a", "2")
+
+	// a written batch can be reused
+	batch.Clear()
+	batch.Put("c", "1")
+	if batch.Len() != 1 {
+		t.Fatalf("cleared batch holds %d operations", batch.Len())
+	}
+
+	if err := atlas.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	expectTestValue(t, atlas, "c", "1")
+}
+
+func TestWriteBatchWithInvalidOperationWritesNothing(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	batch := NewWriteBatch()
+	batch.Put("a", "1")
+	batch.Put("", "1")
+	if err := atlas.Write(batch); err == nil {
+		t.Fatal("batch with an empty key was written")
+	}
+	expectTestValue(t, atlas, "a", "")
+
+	server := createTestServer(t, AtlasServerConfig{})
+	defer server.Shutdown()
+
+	body := `{"operations": [{"op": "put", "key": "a", "value": "1"}, {"op": "merge", "key": "b"}]}`
+	response, _ := serveTestRequest(server, http.MethodPost, "/v1/atlas/batch", body, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("batch with an unknown operation responded %d", response.StatusCode)
+	}
+	expectTestValue(t, server.engine, "a", "")
+}
+
+// Every batch writes the same value to all the keys, readers must never see
+// them differ.
+func TestWriteBatchIsVisibleAtOnce(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	keys := []string{"a", "b", "c", "d"}
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		batch := NewWriteBatch()
+		for round := range 200 {
+			batch.Clear()
+			for _, key := range keys {
+				batch.Put(key, strconv.Itoa(round))
+			}
+
+			if err := atlas.Write(batch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	read := func(snapshot *Snapshot, key string) string {
+		entry, found, err := snapshot.Get(key)
+		if err != nil || !found {
+			return ""
+		}
+		value, _ := entry.Value()
+		return value
+	}
+
+	for range 200 {
+		snapshot := atlas.Snapshot()
+		first := read(snapshot, keys[0])
+		for _, key := range keys[1:] {
+			if value := read(snapshot, key); value != first {
+				t.Fatalf("snapshot read %s=%q and %s=%q", keys[0], first, key, value)
+			}
+		}
+
+		scanned, err := collectTestValues(atlas, IteratorOptions{Snapshot: snapshot})
+		snapshot.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, value := range scanned {
+			if value != first {
+				t.Fatalf("iterator read %v with %s=%q", scanned, keys[0], first)
+			}
+		}
+	}
+	writer.Wait()
+}
+
+func collectTestValues(atlas *Atlas, options IteratorOptions) ([]string, error) {
+	iter, err := atlas.NewIterator(options)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var values []string
+	for ; iter.Valid(); iter.Next() {
+		values = append(values, iter.Value())
+	}
+	return values, iter.Err()
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"atlas/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// A checkpoint directory holds the LSM and the WAL segments of the store in
+// the usual layout, next to its metadata file, which is written last and so
+// marks the checkpoint as complete.
+const (
+	checkpointFilename = "CHECKPOINT"
+	checkpointLsmDir   = "lsm"
+	checkpointWalDir   = "wal"
+)
+
+// Contents of the metadata file of a checkpoint.
+type CheckpointInfo struct {
+	// every write up to this sequence is in the checkpoint
+	Sequence uint64
+	// last sequence of the linked SSTables, the segments hold the rest
+	LsmSequence uint64
+	CreatedAt   time.Time
+	// filenames are relative to the checkpoint directory
+	Segments []storage.WalSegmentInfo
+}
+
+// Directory of the SSTables. Checkpoints written next to it are on the file
+// system of the store, where their tables are hard links rather than copies.
+func (atlas *Atlas) LsmDir() string {
+	return atlas.config.Lsm.Dir
+}
+
+// Writes a consistent copy of the store into the directory, which must not
+// exist yet, without stopping writes. The SSTables are hard linked, so the
+// checkpoint takes little space while it shares them with the store, and the
+// WAL segments backing the memtables are copied up to the last write. The
+// flusher does not remove or archive segments meanwhile.
+//
+// `CheckpointConfig` opens the checkpoint like any other store.
+func (atlas *Atlas) Checkpoint(dir string) (CheckpointInfo, error) {
+	atlas.closeMutex.RLock()
+	defer atlas.closeMutex.RUnlock()
+	if atlas.closed.Load() {
+		return CheckpointInfo{}, ErrClosed
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return CheckpointInfo{}, err
+	}
+
+	info, err := atlas.writeCheckpoint(dir)
+	if err != nil {
+		logger.Error("Failed writing checkpoint into %s: %v", dir, err)
+		os.RemoveAll(dir)
+		return CheckpointInfo{}, err
+	}
+
+	logger.Info("Wrote checkpoint at sequence %d into %s", info.Sequence, dir)
+	return info, nil
+}
+
+func (atlas *Atlas) writeCheckpoint(dir string) (CheckpointInfo, error) {
+	atlas.checkpointMutex.Lock()
+	defer atlas.checkpointMutex.Unlock()
+
+	// taken before the LSM version, which therefore holds everything flushed
+	// from older segments
+	atlas.mutex.RLock()
+	segments := slices.Concat(atlas.immutableSegments, atlas.segments, []*storage.Wal{atlas.wal})
+	atlas.mutex.RUnlock()
+
+	info := CheckpointInfo{CreatedAt: time.Now()}
+	lsmSequence, err := atlas.lsm.Checkpoint(path.Join(dir, checkpointLsmDir))
+	if err != nil {
+		return info, err
+	}
+	info.LsmSequence = lsmSequence
+	info.Sequence = lsmSequence
+
+	if err := os.Mkdir(path.Join(dir, checkpointWalDir), 0755); err != nil {
+		return info, err
+	}
+
+	for _, wal := range segments {
+		filename := path.Join(checkpointWalDir, path.Base(wal.Filename()))
+		segment, err := wal.CopyTo(path.Join(dir, filename))
+		if err != nil {
+			return info, err
+		}
+
+		segment.Filename = filename
+		info.Segments = append(info.Segments, segment)
+		info.Sequence = max(info.Sequence, segment.LastSequence)
+	}
+	return info, writeCheckpointInfo(dir, info)
+}
+
+// Reads the metadata of a complete checkpoint.
+func ReadCheckpointInfo(dir string) (CheckpointInfo, error) {
+	var info CheckpointInfo
+	data, err := os.ReadFile(path.Join(dir, checkpointFilename))
+	if err != nil {
+		return info, fmt.Errorf("Failed reading checkpoint %s: %w", dir, err)
+	}
+
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("Failed reading checkpoint %s: %w", dir, err)
+	}
+	return info, nil
+}
+
+// Points the directories of the config into the checkpoint, so that
+// `NewAtlas` opens it as a normal store. Archiving is disabled, since the
+// archive belongs to the store the checkpoint was taken from. Opening the
+// checkpoint modifies it, a copy has to be opened to keep it intact.
+func CheckpointConfig(dir string, config AtlasConfig) (AtlasConfig, error) {
+	if _, err := ReadCheckpointInfo(dir); err != nil {
+		return config, err
+	}
+
+	config.Lsm.Dir = path.Join(dir, checkpointLsmDir)
+	config.Wal.Dir = path.Join(dir, checkpointWalDir)
+	config.Wal.ArchiveDir = ""
+	return config, nil
+}
+
+func writeCheckpointInfo(dir string, info CheckpointInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path.Join(dir, checkpointFilename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Inserts `key-<n>` for every n in [first, last], each write taking sequence n
+// in a fresh store.
+func insertTestKeys(t *testing.T, atlas *Atlas, first, last int) {
+	t.Helper()
+
+	for idx := first; idx <= last; idx++ {
+		if err := atlas.Insert(fmt.Sprintf("key-%03d", idx), fmt.Sprintf("value-%d", idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Expects exactly the keys inserted by `insertTestKeys` up to the last one.
+func expectTestKeys(t *testing.T, atlas *Atlas, last, total int) {
+	t.Helper()
+
+	for idx := 1; idx <= total; idx++ {
+		expected := ""
+		if idx <= last {
+			expected = fmt.Sprintf("value-%d", idx)
+		}
+		expectTestValue(t, atlas, fmt.Sprintf("key-%03d", idx), expected)
+	}
+}
+
+func TestCheckpointOpensAsStore(t *testing.T) {
+	dir := t.TempDir()
+	config := testAtlasConfig(dir)
+	atlas := openTestAtlas(t, config)
+
+	// spread over the tables and the memtables
+	insertTestKeys(t, atlas, 1, 120)
+	checkpointDir := filepath.Join(dir, "checkpoint")
+	info, err := atlas.Checkpoint(checkpointDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Sequence != 120 || info.LsmSequence > info.Sequence {
+		t.Fatalf("checkpoint is at sequence %d with the tables at %d", info.Sequence, info.LsmSequence)
+	}
+
+	if _, err := atlas.Checkpoint(checkpointDir); err == nil {
+		t.Fatal("checkpoint into an existing directory succeeded")
+	}
+
+	insertTestKeys(t, atlas, 121, 150)
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpointConfig, err := CheckpointConfig(checkpointDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := openTestAtlas(t, checkpointConfig)
+	defer checkpoint.Close()
+	expectTestKeys(t, checkpoint, 120, 150)
+
+	// the store is not affected by writes to the checkpoint
+	if err := checkpoint.Insert("key-001", "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+	expectTestKeys(t, atlas, 150, 150)
+}
+
+func TestCheckpointConfigRejectsIncompleteCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, checkpointLsmDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CheckpointConfig(dir, testAtlasConfig(dir)); err == nil {
+		t.Fatal("opened a checkpoint without its metadata")
+	}
+}
+
+func testArchivingConfig(dir string) AtlasConfig {
+	config := testAtlasConfig(dir)
+	config.Wal.ArchiveDir = filepath.Join(dir, "archive")
+	return config
+}
+
+func TestRecoverToPointReplaysArchiveUpToSequence(t *testing.T) {
+	dir := t.TempDir()
+	config := testArchivingConfig(dir)
+	atlas := openTestAtlas(t, config)
+
+	// closing flushes the writes into the tables of the checkpoint, only
+	// those are used by the recovery
+	insertTestKeys(t, atlas, 1, 30)
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+	atlas = openTestAtlas(t, config)
+
+	checkpointDir := filepath.Join(dir, "checkpoint")
+	info, err := atlas.Checkpoint(checkpointDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.LsmSequence != 30 {
+		t.Fatalf("tables of the checkpoint are at sequence %d", info.LsmSequence)
+	}
+
+	insertTestKeys(t, atlas, 31, 120)
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tables of the checkpoint hold writes past the target
+	if _, err := RecoverToPoint(config, checkpointDir, RecoveryTarget{Sequence: 20}); err == nil {
+		t.Fatal("recovered to a sequence before the checkpoint")
+	}
+
+	recovered, err := RecoverToPoint(config, checkpointDir, RecoveryTarget{Sequence: 75})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered != 75 {
+		t.Fatalf("recovered up to sequence %d", recovered)
+	}
+
+	atlas = openTestAtlas(t, config)
+	expectTestKeys(t, atlas, 75, 120)
+
+	// writes after the recovery continue from its last sequence and are
+	// recovered in place of the discarded ones
+	version, err := atlas.PutIfAbsent("key-076", "after-recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 76 {
+		t.Fatalf("first write after the recovery has sequence %d", version)
+	}
+
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RecoverToPoint(config, checkpointDir, RecoveryTarget{}); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+	expectTestKeys(t, atlas, 75, 75)
+	expectTestValue(t, atlas, "key-076", "after-recovery")
+	expectTestValue(t, atlas, "key-077", "")
+}
+
+func TestRecoverToPointReplaysArchiveUpToTime(t *testing.T) {
+	dir := t.TempDir()
+	config := testArchivingConfig(dir)
+	atlas := openTestAtlas(t, config)
+
+	checkpointDir := filepath.Join(dir, "checkpoint")
+	if _, err := atlas.Checkpoint(checkpointDir); err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestKeys(t, atlas, 1, 60)
+	time.Sleep(10 * time.Millisecond)
+	target := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	insertTestKeys(t, atlas, 61, 100)
+
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := RecoverToPoint(config, checkpointDir, RecoveryTarget{Time: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered != 60 {
+		t.Fatalf("recovered up to sequence %d", recovered)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+	expectTestKeys(t, atlas, 60, 100)
+}
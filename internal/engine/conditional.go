@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"atlas/internal/common"
+	"errors"
+	"time"
+)
+
+// Returned by the conditional writes when the stored entry does not match the
+// expected one. Nothing is written in that case.
+var ErrConditionFailed = errors.New("Conditional write failed - stored entry does not match")
+
+// Condition on the newest live version of a key, which is nil when the key
+// does not exist, is deleted or has expired.
+type writeCondition func(current *common.Entry) bool
+
+// Writes the value only if the key does not exist. Returns the version of the
+// written entry.
+func (atlas *Atlas) PutIfAbsent(key, value string) (uint64, error) {
+	return atlas.writeIf(common.NewEntry(key, value), entryAbsent, WriteOptions{})
+}
+
+// Replaces the value only if the key exists and currently holds `expected`.
+// Returns the version of the written entry.
+func (atlas *Atlas) CompareAndSwap(key, expected, value string) (uint64, error) {
+	return atlas.writeIf(common.NewEntry(key, value), func(current *common.Entry) bool {
+		if current == nil {
+			return false
+		}
+
+		currentValue, _ := current.Value()
+		return currentValue == expected
+	}, WriteOptions{})
+}
+
+// Replaces the value only if the newest version of the key is `version`, the
+// sequence number it was written with. Returns the version of the written
+// entry.
+func (atlas *Atlas) CompareAndSwapVersion(key string, version uint64, value string) (uint64, error) {
+	return atlas.writeIf(common.NewEntry(key, value), hasVersion(version), WriteOptions{})
+}
+
+// Deletes the key only if its newest version is `version`.
+func (atlas *Atlas) DeleteIfVersion(key string, version uint64) error {
+	_, err := atlas.writeIf(common.NewEmptyEntry(key), hasVersion(version), WriteOptions{})
+	return err
+}
+
+func hasVersion(version uint64) writeCondition {
+	return func(current *common.Entry) bool {
+		return current != nil && current.Sequence() == version
+	}
+}
+
+func entryExists(current *common.Entry) bool {
+	return current != nil
+}
+
+func entryAbsent(current *common.Entry) bool {
+	return current == nil
+}
+
+// Writes the entry only if the condition holds for the newest version of its
+// key. The condition is evaluated on the writer goroutine, so no other write
+// can come in between.
+func (atlas *Atlas) writeIf(
+	entry *common.Entry,
+	condition writeCondition,
+	options WriteOptions,
+) (uint64, error) {
+	if entry.Key() == "" {
+		return 0, errors.New("Failed conditional write - empty key")
+	}
+
+	err := atlas.writeChecked([]*common.Entry{entry}, func() error {
+		current, contained, err := atlas.getVersion(entry.Key(), common.MaxSequence)
+		if err != nil {
+			return err
+		}
+
+		if !contained || !current.IsLive(time.Now().UnixMilli()) {
+			current = nil
+		}
+
+		if !condition(current) {
+			return ErrConditionFailed
+		}
+		return nil
+	}, options)
+	if err != nil {
+		return 0, err
+	}
+	return entry.Sequence(), nil
+}
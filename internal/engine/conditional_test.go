@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPutIfAbsent(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	version, err := atlas.PutIfAbsent("a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := atlas.PutIfAbsent("a", "2"); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("put of an existing key returned %v", err)
+	}
+
+	entry, _, err := atlas.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Sequence() != version {
+		t.Fatalf("stored version %d, returned %d", entry.Sequence(), version)
+	}
+
+	// a deleted key is absent
+	if err := atlas.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := atlas.PutIfAbsent("a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	expectTestValue(t, atlas, "a", "3")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	if _, err := atlas.CompareAndSwap("a", "", "1"); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("swap of an absent key returned %v", err)
+	}
+
+	if err := atlas.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := atlas.CompareAndSwap("a", "2", "3"); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("swap of another value returned %v", err)
+	}
+
+	if _, err := atlas.CompareAndSwap("a", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	expectTestValue(t, atlas, "a", "2")
+}
+
+func TestVersionedWrites(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	first, err := atlas.PutIfAbsent("a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := atlas.CompareAndSwapVersion("a", first, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := atlas.CompareAndSwapVersion("a", first, "3"); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("swap of a stale version returned %v", err)
+	}
+
+	if err := atlas.DeleteIfVersion("a", first); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("delete of a stale version returned %v", err)
+	}
+	expectTestValue(t, atlas, "a", "2")
+
+	if err := atlas.DeleteIfVersion("a", second); err != nil {
+		t.Fatal(err)
+	}
+	expectTestValue(t, atlas, "a", "")
+}
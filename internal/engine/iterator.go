@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"atlas/internal/common"
+	"atlas/internal/storage"
+	"time"
+)
+
+type IteratorOptions struct {
+	// Inclusive lower bound of the keys. Empty for no bound.
+	Start string
+	// Exclusive upper bound of the keys. Empty for no bound.
+	End string
+	// Restricts the keys to the ones with the prefix, on top of the bounds.
+	Prefix string
+	// Iterates from the largest key to the smallest one.
+	Reverse bool
+	// Maximum number of entries returned by the iterator. Zero for no limit.
+	Limit int
+	// Reads the state seen by the snapshot instead of the latest one.
+	Snapshot *Snapshot
+}
+
+// Ordered view of the live keys of the engine. Only the newest version of
+// every key is returned and deleted keys are skipped, as are keys which had
+// expired when the iterator was created.
+//
+// The iterator reads the state as of its creation, or as of the snapshot when
+// one is given. It pins the SSTables that were current when it was created,
+// and has to be closed to release them. An iterator must not be used from
+// multiple goroutines at once.
+type Iterator struct {
+	merged   *storage.SnapshotIterator
+	release  func()
+	options  IteratorOptions
+	lower    string
+	upper    string
+	returned int
+	now      int64
+	err      error
+}
+
+func (atlas *Atlas) NewIterator(options IteratorOptions) (*Iterator, error) {
+	if atlas.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	// the pinned tables keep the versions visible at the sequence of the
+	// view, or at the one of the snapshot, which are kept by compactions
+	view, err := atlas.acquireReadView()
+	if err != nil {
+		return nil, err
+	}
+
+	sequence := view.sequence
+	if options.Snapshot != nil {
+		sequence = options.Snapshot.sequence
+	}
+
+	sources := []storage.EntryIterator{view.memtable.Iterator()}
+	if view.immutable != nil {
+		sources = append(sources, view.immutable.Iterator())
+	}
+	sources = append(sources, view.tables.Iterators()...)
+
+	lower, upper := options.Start, options.End
+	if options.Prefix != "" {
+		lower = max(lower, options.Prefix)
+		prefixUpper := prefixUpperBound(options.Prefix)
+		if upper == "" || (prefixUpper != "" && prefixUpper < upper) {
+			upper = prefixUpper
+		}
+	}
+
+	iter := &Iterator{
+		merged:   storage.NewSnapshotIterator(storage.NewMergingIterator(sources), sequence),
+		release:  view.release,
+		options:  options,
+		lower:    lower,
+		upper:    upper,
+		returned: 0,
+		now:      time.Now().UnixMilli(),
+		err:      nil,
+	}
+
+	if options.Reverse {
+		iter.Seek(upper)
+	} else {
+		iter.Seek(lower)
+	}
+
+	if iter.err != nil {
+		iter.Close()
+		return nil, iter.err
+	}
+	return iter, nil
+}
+
+// Returns the live entries with keys in [start, end). An empty bound leaves
+// that side of the range open.
+func (atlas *Atlas) Scan(start, end string) ([]*common.Entry, error) {
+	iter, err := atlas.NewIterator(IteratorOptions{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var result []*common.Entry
+	for ; iter.Valid(); iter.Next() {
+		result = append(result, iter.Entry())
+	}
+	return result, iter.Err()
+}
+
+func (iter *Iterator) Valid() bool {
+	if iter.err != nil || !iter.merged.Valid() {
+		return false
+	}
+
+	if iter.options.Limit > 0 && iter.returned >= iter.options.Limit {
+		return false
+	}
+	return iter.inBounds(iter.merged.Entry().Key())
+}
+
+func (iter *Iterator) Entry() *common.Entry {
+	return iter.merged.Entry()
+}
+
+func (iter *Iterator) Key() string {
+	return iter.merged.Entry().Key()
+}
+
+func (iter *Iterator) Value() string {
+	value, _ := iter.merged.Entry().Value()
+	return value
+}
+
+// Releases the tables pinned by the iterator. Safe to call more than once.
+func (iter *Iterator) Close() {
+	iter.release()
+}
+
+// Error which invalidated the iterator, if any.
+func (iter *Iterator) Err() error {
+	return iter.err
+}
+
+func (iter *Iterator) Next() {
+	iter.returned += 1
+	iter.step()
+	iter.skipDeleted()
+}
+
+// Positions the iterator at the first key in the direction of the iteration
+// which is not before the given one. Keys outside of the bounds are clamped to
+// them. Entries already returned still count towards the limit.
+func (iter *Iterator) Seek(key string) {
+	if iter.err != nil {
+		return
+	}
+
+	if iter.options.Reverse {
+		iter.seekForPrev(key)
+	} else {
+		iter.err = iter.merged.Seek(max(key, iter.lower))
+	}
+	iter.skipDeleted()
+}
+
+func (iter *Iterator) seekForPrev(key string) {
+	if iter.upper != "" && (key == "" || key >= iter.upper) {
+		key = iter.upper
+	}
+
+	if key == "" {
+		iter.err = iter.merged.SeekToLast()
+		return
+	}
+
+	iter.err = iter.merged.SeekForPrev(key)
+	// the upper bound is exclusive
+	if iter.err == nil && iter.merged.Valid() && iter.upper != "" && iter.merged.Entry().Key() >= iter.upper {
+		iter.err = iter.merged.Prev()
+	}
+}
+
+func (iter *Iterator) step() {
+	if iter.options.Reverse {
+		iter.err = iter.merged.Prev()
+	} else {
+		iter.err = iter.merged.Next()
+	}
+}
+
+func (iter *Iterator) skipDeleted() {
+	for iter.err == nil && iter.merged.Valid() && !iter.merged.Entry().IsLive(iter.now) {
+		if !iter.inBounds(iter.merged.Entry().Key()) {
+			return
+		}
+		iter.step()
+	}
+}
+
+func (iter *Iterator) inBounds(key string) bool {
+	if key < iter.lower {
+		return false
+	}
+	return iter.upper == "" || key < iter.upper
+}
+
+// Returns the smallest key greater than every key with the prefix, or an empty
+// string when there is no such key.
+func prefixUpperBound(prefix string) string {
+	bound := []byte(prefix)
+	for idx := len(bound) - 1; idx >= 0; idx-- {
+		if bound[idx] < 0xff {
+			bound[idx] += 1
+			return string(bound[:idx+1])
+		}
+	}
+	return ""
+}
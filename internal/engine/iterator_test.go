@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func collectTestKeys(t *testing.T, atlas *Atlas, options IteratorOptions) []string {
+	t.Helper()
+
+	iter, err := atlas.NewIterator(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestIteratorBoundsAndDirections(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	// enough writes to spread the keys over the memtables and several tables,
+	// with every third key deleted and every fifth one overwritten
+	var live []string
+	for idx := range 150 {
+		key := fmt.Sprintf("key-%03d", idx)
+		if err := atlas.Insert(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for idx := range 150 {
+		key := fmt.Sprintf("key-%03d", idx)
+		switch {
+		case idx%3 == 0:
+			if err := atlas.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		case idx%5 == 0:
+			if err := atlas.Insert(key, "new"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		live = append(live, key)
+	}
+
+	filter := func(keep func(key string) bool) []string {
+		var keys []string
+		for _, key := range live {
+			if keep(key) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	reversed := func(keys []string) []string {
+		keys = slices.Clone(keys)
+		slices.Reverse(keys)
+		return keys
+	}
+
+	inRange := filter(func(key string) bool { return key >= "key-020" && key < "key-100" })
+	deletedBounds := filter(func(key string) bool { return key >= "key-021" && key < "key-099" })
+	prefixed := filter(func(key string) bool { return key >= "key-12" && key < "key-13" })
+	cases := []struct {
+		name     string
+		options  IteratorOptions
+		expected []string
+	}{
+		{"all", IteratorOptions{}, live},
+		{"all reversed", IteratorOptions{Reverse: true}, reversed(live)},
+		{"range", IteratorOptions{Start: "key-020", End: "key-100"}, inRange},
+		{"range reversed", IteratorOptions{Start: "key-020", End: "key-100", Reverse: true}, reversed(inRange)},
+		{"deleted bounds reversed", IteratorOptions{Start: "key-021", End: "key-099", Reverse: true}, reversed(deletedBounds)},
+		{"prefix", IteratorOptions{Prefix: "key-12"}, prefixed},
+		{"prefix reversed", IteratorOptions{Prefix: "key-12", Reverse: true}, reversed(prefixed)},
+		{"limit", IteratorOptions{Start: "key-020", Limit: 3}, inRange[:3]},
+		{"limit reversed", IteratorOptions{End: "key-100", Limit: 3, Reverse: true}, reversed(inRange)[:3]},
+		{"empty range", IteratorOptions{Start: "key-050", End: "key-050"}, nil},
+	}
+
+	for _, test := range cases {
+		if keys := collectTestKeys(t, atlas, test.options); !slices.Equal(keys, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, keys, test.expected)
+		}
+	}
+}
+
+func TestIteratorSeekInReverse(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	for _, key := range []string{"a", "c", "e", "g"} {
+		if err := atlas.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter, err := atlas.NewIterator(IteratorOptions{End: "g", Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	// seeks land on the first key not after the given one
+	for _, seek := range []struct{ key, expected string }{{"d", "c"}, {"e", "e"}, {"z", "e"}} {
+		iter.Seek(seek.key)
+		if !iter.Valid() || iter.Key() != seek.expected {
+			t.Fatalf("seek to %s is not at %s", seek.key, seek.expected)
+		}
+	}
+
+	iter.Seek("0")
+	if iter.Valid() {
+		t.Fatalf("seek before the first key is at %s", iter.Key())
+	}
+}
+
+func TestIteratorReadsSnapshot(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	for _, key := range []string{"a", "b"} {
+		if err := atlas.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := atlas.Snapshot()
+	defer snapshot.Release()
+
+	if err := atlas.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.Insert("c", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := collectTestKeys(t, atlas, IteratorOptions{Snapshot: snapshot, Reverse: true}); !slices.Equal(keys, []string{"b", "a"}) {
+		t.Fatalf("snapshot iterator got %v", keys)
+	}
+
+	if keys := collectTestKeys(t, atlas, IteratorOptions{}); !slices.Equal(keys, []string{"b", "c"}) {
+		t.Fatalf("iterator got %v", keys)
+	}
+}
+
+func TestIteratorKeepsItsVersionsAcrossCompactions(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	insertTestKeys(t, atlas, 1, 100)
+	iter, err := atlas.NewIterator(IteratorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	// plain reads pin the tables only, compactions may drop their versions
+	// from the newer tables
+	if sequences := atlas.lsm.Snapshots().Sequences(); len(sequences) != 0 {
+		t.Fatalf("iterator registered snapshots %v", sequences)
+	}
+
+	for range 3 {
+		for idx := 1; idx <= 100; idx++ {
+			if err := atlas.Insert(fmt.Sprintf("key-%03d", idx), "overwritten"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count += 1
+		if expected := fmt.Sprintf("value-%d", count); iter.Value() != expected {
+			t.Fatalf("iterator read %q for %s, expected %q", iter.Value(), iter.Key(), expected)
+		}
+	}
+
+	if err := iter.Err(); err != nil || count != 100 {
+		t.Fatalf("iterator read %d keys: %v", count, err)
+	}
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"atlas/pkg/logger"
+	"cmp"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+var walRegex = regexp.MustCompile(`^(\d+)\.wal$`)
+
+// Segments are named by their first sequence, padded so that the names sort in
+// the order of the segments. Logs of older versions were named by their
+// creation time in milliseconds and are older than any segment.
+const walSequenceDigits = 20
+
+// Lists the live WAL segments from the oldest to the newest: those backing the
+// memtable being flushed, those backing the active memtable and finally the
+// active segment.
+func (atlas *Atlas) WalSegments() []storage.WalSegmentInfo {
+	atlas.mutex.RLock()
+	segments := slices.Concat(atlas.immutableSegments, atlas.segments, []*storage.Wal{atlas.wal})
+	atlas.mutex.RUnlock()
+
+	infos := make([]storage.WalSegmentInfo, 0, len(segments))
+	for _, wal := range segments {
+		infos = append(infos, wal.Info())
+	}
+	return infos
+}
+
+// Seals the active segment and starts a new one backing the same memtable. If
+// that would exceed `MaxLogs`, the memtable is rotated instead, so that its
+// segments are removed once it is flushed.
+func (atlas *Atlas) rotateSegment() error {
+	if atlas.exceedsMaxLogs(1) {
+		return atlas.rotateMemtable()
+	}
+
+	wal, err := atlas.createWal()
+	if err != nil {
+		return err
+	}
+
+	sealedWal := atlas.wal
+	if err := atlas.sealWal(sealedWal); err != nil {
+		atlas.discardWal(wal)
+		return err
+	}
+
+	atlas.mutex.Lock()
+	atlas.wal = wal
+	atlas.segments = append(atlas.segments, sealedWal)
+	atlas.mutex.Unlock()
+	return nil
+}
+
+// Reports whether more than `MaxLogs` segments would be live after adding
+// the given number of them.
+func (atlas *Atlas) exceedsMaxLogs(added int) bool {
+	maxLogs := atlas.config.Wal.MaxLogs
+	atlas.mutex.RLock()
+	live := len(atlas.immutableSegments) + len(atlas.segments) + 1
+	atlas.mutex.RUnlock()
+	return maxLogs > 0 && live+added > maxLogs
+}
+
+// Writes acknowledged before their sync is due must not be lost once the
+// segment stops being the active one.
+func (atlas *Atlas) sealWal(wal *storage.Wal) error {
+	if err := atlas.syncWal(wal); err != nil {
+		return err
+	}
+	return wal.Close()
+}
+
+// Removes a segment created for a rotation that failed.
+func (atlas *Atlas) discardWal(wal *storage.Wal) {
+	wal.Close()
+	if err := os.Remove(wal.Filename()); err != nil {
+		logger.Warn("Failed removing WAL %s: %v", wal.Filename(), err)
+	}
+}
+
+// Every sequence of a segment is greater than those of the segments before it,
+// so naming them by their first sequence keeps them unique.
+func (atlas *Atlas) createWal() (*storage.Wal, error) {
+	return storage.CreateWal(atlas.buildWalFilename(atlas.lastSequence + 1))
+}
+
+func (atlas *Atlas) buildWalFilename(firstSequence uint64) string {
+	filename := fmt.Sprintf("%0*d.wal", walSequenceDigits, firstSequence)
+	return path.Join(atlas.config.Wal.Dir, filename)
+}
+
+// Returns the paths of the WAL files in the order they are replayed, logs
+// named by their creation time before the segments.
+func listWalFiles(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type walFile struct {
+		name     string
+		isLegacy bool
+		number   uint64
+	}
+
+	var files []walFile
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+
+		matches := walRegex.FindStringSubmatch(dirEntry.Name())
+		if len(matches) != 2 {
+			continue
+		}
+
+		number, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, walFile{
+			name:     dirEntry.Name(),
+			isLegacy: len(matches[1]) != walSequenceDigits,
+			number:   number,
+		})
+	}
+
+	slices.SortFunc(files, func(a, b walFile) int {
+		if a.isLegacy != b.isLegacy {
+			if a.isLegacy {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.number, b.number)
+	})
+
+	filenames := make([]string, 0, len(files))
+	for _, file := range files {
+		filenames = append(filenames, path.Join(dir, file.name))
+	}
+	return filenames, nil
+}
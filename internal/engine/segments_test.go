@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Checks that the segments hold consecutive sequences and returns the number
+// of entries in them.
+func checkTestSegments(t *testing.T, segments []storage.WalSegmentInfo) int {
+	t.Helper()
+
+	entries := 0
+	for idx, segment := range segments {
+		entries += segment.Entries
+		if idx > 0 && segment.Entries > 0 && segment.FirstSequence != segments[idx-1].LastSequence+1 {
+			t.Fatalf("segment %s starts at %d after %d", segment.Filename, segment.FirstSequence, segments[idx-1].LastSequence)
+		}
+	}
+	return entries
+}
+
+func TestWalSegmentsRotateBySize(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.MaxEntries = 1000
+	config.Wal.SegmentSize = 256
+	atlas := openTestAtlas(t, config)
+	defer atlas.Close()
+
+	for idx := range 40 {
+		if err := atlas.Insert(fmt.Sprintf("key-%02d", idx), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := atlas.WalSegments()
+	if len(segments) < 3 {
+		t.Fatalf("40 writes were kept in %d segments", len(segments))
+	}
+
+	for _, segment := range segments[:len(segments)-1] {
+		if segment.Size < config.Wal.SegmentSize {
+			t.Fatalf("segment %s was sealed at %d bytes", segment.Filename, segment.Size)
+		}
+	}
+
+	if entries := checkTestSegments(t, segments); entries != 40 {
+		t.Fatalf("segments hold %d entries", entries)
+	}
+}
+
+func TestWalSegmentsRotateByAge(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.SegmentSize = 0
+	config.Wal.SegmentMaxAge = 20 * time.Millisecond
+	atlas := openTestAtlas(t, config)
+	defer atlas.Close()
+
+	if err := atlas.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated without any further write
+	deadline := time.Now().Add(5 * time.Second)
+	for len(atlas.WalSegments()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("segment was not rotated once it aged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// an empty segment is not rotated however old it is
+	time.Sleep(5 * config.Wal.SegmentMaxAge)
+	segments := atlas.WalSegments()
+	if len(segments) != 2 || segments[0].Entries != 1 || segments[1].Entries != 0 {
+		t.Fatalf("got segments %+v", segments)
+	}
+}
+
+func TestWalSegmentsStayWithinMaxLogs(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	config.Wal.MaxEntries = 1000
+	config.Wal.SegmentSize = 128
+	config.Wal.MaxLogs = 3
+	atlas := openTestAtlas(t, config)
+
+	for idx := range 100 {
+		if err := atlas.Insert(fmt.Sprintf("key-%02d", idx), "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		// the segments of the memtable being flushed are live next to the
+		// new active one until the flush completes
+		if segments := atlas.WalSegments(); len(segments) > config.Wal.MaxLogs+1 {
+			t.Fatalf("%d segments are live after %d writes", len(segments), idx+1)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(atlas.WalSegments()) > config.Wal.MaxLogs {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d segments are still live after the flush", len(atlas.WalSegments()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+	for idx := range 100 {
+		expectTestValue(t, atlas, fmt.Sprintf("key-%02d", idx), "value")
+	}
+}
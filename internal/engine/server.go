@@ -1,53 +1,176 @@
 package engine
 
 import (
+	"atlas/internal/common"
 	"atlas/pkg/logger"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
 	getEntryEndpoint    = "GET /v1/atlas"
 	putEntryEndpoint    = "PUT /v1/atlas"
 	deleteEntryEndpoint = "DELETE /v1/atlas"
+	scanEntriesEndpoint = "GET /v1/atlas/scan"
+	writeBatchEndpoint  = "POST /v1/atlas/batch"
+	getStatsEndpoint    = "GET /v1/stats"
+	walSegmentsEndpoint = "GET /v1/wal/segments"
+	checkpointEndpoint  = "POST /v1/admin/checkpoint"
+
+	beginTxnEndpoint    = "POST /v1/txn"
+	getTxnEntryEndpoint = "GET /v1/txn/{id}/atlas"
+	putTxnEntryEndpoint = "PUT /v1/txn/{id}/atlas"
+	deleteTxnEndpoint   = "DELETE /v1/txn/{id}/atlas"
+	commitTxnEndpoint   = "POST /v1/txn/{id}/commit"
+	rollbackTxnEndpoint = "POST /v1/txn/{id}/rollback"
+)
+
+const defaultTransactionIdleTimeout = time.Minute
+
+const defaultShutdownTimeout = 10 * time.Second
+
+const (
+	batchPutOperation    = "put"
+	batchDeleteOperation = "delete"
 )
 
+type batchRequest struct {
+	Operations []batchRequestOperation `json:"operations"`
+}
+
+type batchRequestOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanResponseEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type beginTxnResponse struct {
+	ID string `json:"id"`
+}
+
+type checkpointResponse struct {
+	// where the checkpoint was written on the server's file system
+	Dir string
+	CheckpointInfo
+}
+
+// Transaction opened over HTTP. Requests for the same transaction may arrive
+// concurrently, so they are serialized by the mutex.
+type serverTransaction struct {
+	mutex    sync.Mutex
+	txn      *Transaction
+	lastUsed time.Time
+}
+
 type AtlasServerConfig struct {
 	Engine AtlasConfig
 	Port   int
+	// How long in-flight requests may take to finish on shutdown. Defaults to
+	// `defaultShutdownTimeout`.
+	ShutdownTimeout time.Duration
+	// Directory the checkpoint endpoint writes into, clients only name the
+	// checkpoint within it. The endpoint is disabled when empty.
+	CheckpointDir string
+	// Transactions left open by clients are rolled back after this long
+	// without a request, so that their snapshots do not pin old versions
+	// forever. Defaults to `defaultTransactionIdleTimeout`.
+	TransactionIdleTimeout time.Duration
 }
 
 type AtlasServer struct {
-	engine *Atlas
-	mux    *http.ServeMux
-	config AtlasServerConfig
+	engine     *Atlas
+	mux        *http.ServeMux
+	httpServer *http.Server
+	config     AtlasServerConfig
+
+	transactionsMutex sync.Mutex
+	transactions      map[string]*serverTransaction
+
+	stopExpiry chan struct{}
+	expiryDone chan struct{}
 }
 
 func CreateAtlasServer(config AtlasServerConfig) (*AtlasServer, error) {
+	if config.CheckpointDir != "" {
+		// clients on the same host use the paths of the checkpoints
+		dir, err := filepath.Abs(config.CheckpointDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Error("Failed creating checkpoint directory: %v", err)
+			return nil, err
+		}
+		config.CheckpointDir = dir
+	}
+
 	engine, err := NewAtlas(config.Engine)
 	if err != nil {
 		logger.Error("Failed initializing Atlas server engine: %v", err)
 		return nil, err
 	}
 
-	server := &AtlasServer{engine: engine, config: config}
+	if config.TransactionIdleTimeout <= 0 {
+		config.TransactionIdleTimeout = defaultTransactionIdleTimeout
+	}
+
+	server := &AtlasServer{
+		engine:       engine,
+		config:       config,
+		transactions: make(map[string]*serverTransaction),
+		stopExpiry:   make(chan struct{}),
+		expiryDone:   make(chan struct{}),
+	}
 
 	server.mux = http.NewServeMux()
 	server.mux.HandleFunc("GET /v1/atlas", server.handleGet)
 	server.mux.HandleFunc("PUT /v1/atlas", server.handlePut)
 	server.mux.HandleFunc("DELETE /v1/atlas", server.handleDelete)
+	server.mux.HandleFunc(scanEntriesEndpoint, server.handleScan)
+	server.mux.HandleFunc(writeBatchEndpoint, server.handleBatch)
+	server.mux.HandleFunc(getStatsEndpoint, server.handleStats)
+	server.mux.HandleFunc(walSegmentsEndpoint, server.handleWalSegments)
+	server.mux.HandleFunc(checkpointEndpoint, server.handleCheckpoint)
+	server.mux.HandleFunc(beginTxnEndpoint, server.handleBeginTxn)
+	server.mux.HandleFunc(getTxnEntryEndpoint, server.handleTxnGet)
+	server.mux.HandleFunc(putTxnEntryEndpoint, server.handleTxnPut)
+	server.mux.HandleFunc(deleteTxnEndpoint, server.handleTxnDelete)
+	server.mux.HandleFunc(commitTxnEndpoint, server.handleCommitTxn)
+	server.mux.HandleFunc(rollbackTxnEndpoint, server.handleRollbackTxn)
 
+	server.httpServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: server.mux,
+	}
+
+	go server.runTransactionExpiry()
 	return server, nil
 }
 
+// Serves requests until SIGINT or SIGTERM, then shuts the server down.
 func (server *AtlasServer) Start() {
 	go func() {
-		port := fmt.Sprintf(":%d", server.config.Port)
-		logger.Info("Starting Atlas server on %s", port)
-		if err := http.ListenAndServe(port, server.mux); err != nil {
+		logger.Info("Starting Atlas server on %s", server.httpServer.Addr)
+		err := server.httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatal(1, "Failed starting server: %v", err)
 		}
 	}()
@@ -56,7 +179,49 @@ func (server *AtlasServer) Start() {
 	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
 	<-termChan
 
+	if err := server.Shutdown(); err != nil {
+		logger.Error("Failed shutting down Atlas server: %v", err)
+	}
+}
+
+// Stops accepting connections and waits for the in-flight requests up to the
+// shutdown timeout, then rolls back the open transactions and closes the
+// engine.
+func (server *AtlasServer) Shutdown() error {
 	logger.Info("Shutting down Atlas server...")
+	timeout := server.config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	if err := server.httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("Failed draining requests: %w", err))
+	}
+
+	close(server.stopExpiry)
+	<-server.expiryDone
+
+	server.transactionsMutex.Lock()
+	transactions := server.transactions
+	server.transactions = make(map[string]*serverTransaction)
+	server.transactionsMutex.Unlock()
+
+	// requests still running hold their transaction while they take the
+	// transactions lock, so it must not be held here
+	for _, serverTxn := range transactions {
+		serverTxn.mutex.Lock()
+		serverTxn.txn.Rollback()
+		serverTxn.mutex.Unlock()
+	}
+
+	if err := server.engine.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("Failed closing engine: %w", err))
+	}
+	return errors.Join(errs...)
 }
 
 func (server *AtlasServer) handleGet(response http.ResponseWriter, request *http.Request) {
@@ -73,18 +238,30 @@ func (server *AtlasServer) handleGet(response http.ResponseWriter, request *http
 		return
 	}
 
+	if !exists {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	value, isAlive := result.Value()
-	if !exists || !isAlive {
+	if !isAlive {
 		response.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	response.Header().Set("ETag", formatETag(result.Sequence()))
 	_, err = response.Write([]byte(value))
 	if err != nil {
 		logger.Error("Failed writing response in `%s`: %v", getEntryEndpoint, err)
 	}
 }
 
+// Writes the value, conditionally when the request carries `If-None-Match: *`
+// (only if the key does not exist) or `If-Match` with the ETag of the current
+// version or `*` (only if the key exists). A failed condition responds with 412.
+// The value expires after the duration in the `ttl` parameter or the `X-TTL`
+// header, e.g. `30s`, when one is given. `X-Sync: true` syncs the WAL before
+// responding, like for the other writes.
 func (server *AtlasServer) handlePut(response http.ResponseWriter, request *http.Request) {
 	key, exists := getQueryParameter("key", putEntryEndpoint, response, request)
 	if !exists {
@@ -96,34 +273,540 @@ func (server *AtlasServer) handlePut(response http.ResponseWriter, request *http
 		return
 	}
 
-	err := server.engine.Insert(key, value)
+	ttl, valid := getTTL(putEntryEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	options, valid := getWriteOptions(putEntryEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	condition, conditional, valid := getWriteCondition(putEntryEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	entry := common.NewEntry(key, value)
+	if ttl > 0 {
+		entry = common.NewEntryWithTTL(key, value, ttl)
+	}
+
+	var version uint64
+	var err error
+	if conditional {
+		version, err = server.engine.writeIf(entry, condition, options)
+	} else {
+		err = server.engine.write([]*common.Entry{entry}, options)
+	}
+
+	if errors.Is(err, ErrConditionFailed) {
+		http.Error(response, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
 	if err != nil {
 		logger.Error("Failed `%s`: %v", putEntryEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
+	if conditional {
+		response.Header().Set("ETag", formatETag(version))
+	}
 	response.WriteHeader(http.StatusCreated)
 }
 
+// Deletes the key, conditionally when the request carries `If-Match`. A failed
+// condition responds with 412.
 func (server *AtlasServer) handleDelete(response http.ResponseWriter, request *http.Request) {
 	key, exists := getQueryParameter("key", deleteEntryEndpoint, response, request)
 	if !exists {
 		return
 	}
 
-	err := server.engine.Delete(key)
+	condition, conditional, valid := getWriteCondition(deleteEntryEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	options, valid := getWriteOptions(deleteEntryEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	entry := common.NewEmptyEntry(key)
+	var err error
+	if conditional {
+		_, err = server.engine.writeIf(entry, condition, options)
+	} else {
+		err = server.engine.write([]*common.Entry{entry}, options)
+	}
+
+	if errors.Is(err, ErrConditionFailed) {
+		http.Error(response, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
 	if err != nil {
 		logger.Error("Failed `%s`: %v", deleteEntryEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+// Returns the live entries selected by the optional `start`, `end`, `prefix`,
+// `reverse` and `limit` parameters as a JSON array.
+func (server *AtlasServer) handleScan(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	options := IteratorOptions{
+		Start:  query.Get("start"),
+		End:    query.Get("end"),
+		Prefix: query.Get("prefix"),
+	}
+
+	var err error
+	if reverse := query.Get("reverse"); reverse != "" {
+		if options.Reverse, err = strconv.ParseBool(reverse); err != nil {
+			http.Error(response, "Invalid query parameter `reverse`", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if options.Limit, err = strconv.Atoi(limit); err != nil || options.Limit < 0 {
+			http.Error(response, "Invalid query parameter `limit`", http.StatusBadRequest)
+			return
+		}
+	}
+
+	iter, err := server.engine.NewIterator(options)
+	if err != nil {
+		logger.Error("Failed `%s`: %v", scanEntriesEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer iter.Close()
+
+	entries := []scanResponseEntry{}
+	for ; iter.Valid(); iter.Next() {
+		entries = append(entries, scanResponseEntry{Key: iter.Key(), Value: iter.Value()})
+	}
+
+	if err := iter.Err(); err != nil {
+		logger.Error("Failed `%s`: %v", scanEntriesEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(entries); err != nil {
+		logger.Error("Failed writing response in `%s`: %v", scanEntriesEndpoint, err)
+	}
+}
+
+// Applies all operations of the request body atomically. The body is a JSON
+// object with an `operations` array of `{"op": "put"|"delete", "key", "value"}`.
+func (server *AtlasServer) handleBatch(response http.ResponseWriter, request *http.Request) {
+	options, valid := getWriteOptions(writeBatchEndpoint, response, request)
+	if !valid {
+		return
+	}
+
+	var body batchRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		logger.Warn("Malformed `%s` request - %v", writeBatchEndpoint, err)
+		http.Error(response, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	batch := NewWriteBatch()
+	for _, operation := range body.Operations {
+		if operation.Key == "" {
+			http.Error(response, "Missing key in batch operation", http.StatusBadRequest)
+			return
+		}
+
+		switch operation.Op {
+		case batchPutOperation:
+			batch.Put(operation.Key, operation.Value)
+		case batchDeleteOperation:
+			batch.Delete(operation.Key)
+		default:
+			msg := fmt.Sprintf("Unknown batch operation `%s`", operation.Op)
+			http.Error(response, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := server.engine.WriteWithOptions(batch, options); err != nil {
+		logger.Error("Failed `%s`: %v", writeBatchEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	response.WriteHeader(http.StatusOK)
 }
 
+func (server *AtlasServer) handleStats(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(response).Encode(server.engine.Stats())
+	if err != nil {
+		logger.Error("Failed writing response in `%s`: %v", getStatsEndpoint, err)
+	}
+}
+
+func (server *AtlasServer) handleWalSegments(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(response).Encode(server.engine.WalSegments())
+	if err != nil {
+		logger.Error("Failed writing response in `%s`: %v", walSegmentsEndpoint, err)
+	}
+}
+
+// Writes a checkpoint into the subdirectory `name` of the configured checkpoint
+// directory, which must not exist yet, and returns its path and metadata. The
+// name is a single path element, so that clients cannot write anywhere else on
+// the server's file system.
+func (server *AtlasServer) handleCheckpoint(response http.ResponseWriter, request *http.Request) {
+	if server.config.CheckpointDir == "" {
+		http.Error(response, "Checkpoints are disabled", http.StatusForbidden)
+		return
+	}
+
+	name, exists := getQueryParameter("name", checkpointEndpoint, response, request)
+	if !exists {
+		return
+	}
+
+	if !filepath.IsLocal(name) || filepath.Base(name) != name {
+		logger.Warn("Malformed `%s` request - invalid checkpoint name `%s`", checkpointEndpoint, name)
+		http.Error(response, "Checkpoint name must be a single path element", http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Join(server.config.CheckpointDir, name)
+	info, err := server.engine.Checkpoint(dir)
+	if os.IsExist(err) {
+		http.Error(response, "Checkpoint directory already exists", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		logger.Error("Failed `%s`: %v", checkpointEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	body := checkpointResponse{Dir: dir, CheckpointInfo: info}
+	if err := json.NewEncoder(response).Encode(body); err != nil {
+		logger.Error("Failed writing response in `%s`: %v", checkpointEndpoint, err)
+	}
+}
+
+// Starts a transaction and returns its id, which addresses it in the other
+// `/v1/txn/{id}` endpoints.
+func (server *AtlasServer) handleBeginTxn(response http.ResponseWriter, request *http.Request) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		logger.Error("Failed `%s`: %v", beginTxnEndpoint, err)
+		http.Error(response, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	server.transactionsMutex.Lock()
+	server.transactions[id] = &serverTransaction{
+		txn:      server.engine.Begin(),
+		lastUsed: time.Now(),
+	}
+	server.transactionsMutex.Unlock()
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(response).Encode(beginTxnResponse{ID: id}); err != nil {
+		logger.Error("Failed writing response in `%s`: %v", beginTxnEndpoint, err)
+	}
+}
+
+func (server *AtlasServer) handleTxnGet(response http.ResponseWriter, request *http.Request) {
+	key, exists := getQueryParameter("key", getTxnEntryEndpoint, response, request)
+	if !exists {
+		return
+	}
+
+	server.withTransaction(getTxnEntryEndpoint, response, request, func(txn *Transaction) {
+		result, exists, err := txn.Get(key)
+		if err != nil {
+			logger.Error("Failed `%s`: %v", getTxnEntryEndpoint, err)
+			http.Error(response, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !exists {
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		value, isAlive := result.Value()
+		if !isAlive {
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if _, err := response.Write([]byte(value)); err != nil {
+			logger.Error("Failed writing response in `%s`: %v", getTxnEntryEndpoint, err)
+		}
+	})
+}
+
+func (server *AtlasServer) handleTxnPut(response http.ResponseWriter, request *http.Request) {
+	key, exists := getQueryParameter("key", putTxnEntryEndpoint, response, request)
+	if !exists {
+		return
+	}
+
+	value, exists := getQueryParameter("value", putTxnEntryEndpoint, response, request)
+	if !exists {
+		return
+	}
+
+	server.withTransaction(putTxnEntryEndpoint, response, request, func(txn *Transaction) {
+		if err := txn.Insert(key, value); err != nil {
+			logger.Error("Failed `%s`: %v", putTxnEntryEndpoint, err)
+			http.Error(response, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusCreated)
+	})
+}
+
+func (server *AtlasServer) handleTxnDelete(response http.ResponseWriter, request *http.Request) {
+	key, exists := getQueryParameter("key", deleteTxnEndpoint, response, request)
+	if !exists {
+		return
+	}
+
+	server.withTransaction(deleteTxnEndpoint, response, request, func(txn *Transaction) {
+		if err := txn.Delete(key); err != nil {
+			logger.Error("Failed `%s`: %v", deleteTxnEndpoint, err)
+			http.Error(response, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusOK)
+	})
+}
+
+// Commits the transaction, responding with 409 Conflict if a key it read was
+// modified since it began. The transaction is finished either way.
+func (server *AtlasServer) handleCommitTxn(response http.ResponseWriter, request *http.Request) {
+	server.withTransaction(commitTxnEndpoint, response, request, func(txn *Transaction) {
+		server.removeTransaction(request.PathValue("id"))
+
+		err := txn.Commit()
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			http.Error(response, conflict.Error(), http.StatusConflict)
+			return
+		}
+
+		if err != nil {
+			logger.Error("Failed `%s`: %v", commitTxnEndpoint, err)
+			http.Error(response, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusOK)
+	})
+}
+
+func (server *AtlasServer) handleRollbackTxn(response http.ResponseWriter, request *http.Request) {
+	server.withTransaction(rollbackTxnEndpoint, response, request, func(txn *Transaction) {
+		server.removeTransaction(request.PathValue("id"))
+		txn.Rollback()
+		response.WriteHeader(http.StatusOK)
+	})
+}
+
+// Runs the handler with the transaction of the `id` path parameter held
+// exclusively, or responds with 404 if there is no such transaction.
+func (server *AtlasServer) withTransaction(
+	url string,
+	response http.ResponseWriter,
+	request *http.Request,
+	handle func(*Transaction),
+) {
+	id := request.PathValue("id")
+	server.transactionsMutex.Lock()
+	serverTxn, exists := server.transactions[id]
+	server.transactionsMutex.Unlock()
+
+	if !exists {
+		logger.Warn("Malformed `%s` request - unknown transaction `%s`", url, id)
+		http.Error(response, "Unknown transaction", http.StatusNotFound)
+		return
+	}
+
+	serverTxn.mutex.Lock()
+	defer serverTxn.mutex.Unlock()
+
+	// finished by a concurrent commit, rollback or expiry
+	if serverTxn.txn.isDone {
+		http.Error(response, "Unknown transaction", http.StatusNotFound)
+		return
+	}
+
+	serverTxn.lastUsed = time.Now()
+	handle(serverTxn.txn)
+}
+
+func (server *AtlasServer) removeTransaction(id string) {
+	server.transactionsMutex.Lock()
+	defer server.transactionsMutex.Unlock()
+	delete(server.transactions, id)
+}
+
+// Expires the idle transactions in the background, checking twice per idle
+// timeout, until the server shuts down.
+func (server *AtlasServer) runTransactionExpiry() {
+	defer close(server.expiryDone)
+
+	ticker := time.NewTicker(server.config.TransactionIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.stopExpiry:
+			return
+		case <-ticker.C:
+			server.expireIdleTransactions()
+		}
+	}
+}
+
+// Rolls back the transactions idle for longer than the idle timeout.
+func (server *AtlasServer) expireIdleTransactions() {
+	server.transactionsMutex.Lock()
+	defer server.transactionsMutex.Unlock()
+
+	timeout := server.config.TransactionIdleTimeout
+	now := time.Now()
+	for id, serverTxn := range server.transactions {
+		// busy transactions are in use, so not idle
+		if !serverTxn.mutex.TryLock() {
+			continue
+		}
+
+		if now.Sub(serverTxn.lastUsed) > timeout {
+			logger.Warn("Rolling back transaction `%s` idle for over %v", id, timeout)
+			serverTxn.txn.Rollback()
+			delete(server.transactions, id)
+		}
+		serverTxn.mutex.Unlock()
+	}
+}
+
+// Reads the options of a write from the headers. `X-Sync: true` syncs the WAL
+// before the write is acknowledged.
+func getWriteOptions(url string, response http.ResponseWriter, request *http.Request) (WriteOptions, bool) {
+	var options WriteOptions
+	if raw := request.Header.Get("X-Sync"); raw != "" {
+		var err error
+		if options.Sync, err = strconv.ParseBool(raw); err != nil {
+			logger.Warn("Malformed `%s` request - invalid `X-Sync: %s`", url, raw)
+			http.Error(response, "Invalid `X-Sync` header", http.StatusBadRequest)
+			return options, false
+		}
+	}
+	return options, true
+}
+
+// Reads the optional TTL of a write from the `ttl` parameter, falling back to
+// the `X-TTL` header. Zero when neither is set.
+func getTTL(url string, response http.ResponseWriter, request *http.Request) (time.Duration, bool) {
+	raw := request.URL.Query().Get("ttl")
+	if raw == "" {
+		raw = request.Header.Get("X-TTL")
+	}
+
+	if raw == "" {
+		return 0, true
+	}
+
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		logger.Warn("Malformed `%s` request - invalid TTL `%s`", url, raw)
+		http.Error(response, "TTL has to be a positive duration, e.g. `30s`", http.StatusBadRequest)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// Reads the precondition of a write from the `If-Match` and `If-None-Match`
+// headers. Only `If-None-Match: *` is accepted from the latter, as writes have
+// no representation to compare against otherwise.
+func getWriteCondition(
+	url string,
+	response http.ResponseWriter,
+	request *http.Request,
+) (condition writeCondition, conditional bool, valid bool) {
+	ifMatch := request.Header.Get("If-Match")
+	ifNoneMatch := request.Header.Get("If-None-Match")
+
+	if ifMatch != "" && ifNoneMatch != "" {
+		logger.Warn("Malformed `%s` request - both `If-Match` and `If-None-Match` set", url)
+		http.Error(response, "Only one of `If-Match` and `If-None-Match` is allowed", http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	switch {
+	case ifNoneMatch == "*":
+		return entryAbsent, true, true
+	case ifMatch == "*":
+		return entryExists, true, true
+	case ifMatch != "":
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			logger.Warn("Malformed `%s` request - %v", url, err)
+			http.Error(response, "Invalid `If-Match` header", http.StatusBadRequest)
+			return nil, false, false
+		}
+		return hasVersion(version), true, true
+	case ifNoneMatch != "":
+		logger.Warn("Malformed `%s` request - unsupported `If-None-Match: %s`", url, ifNoneMatch)
+		http.Error(response, "Only `If-None-Match: *` is supported", http.StatusBadRequest)
+		return nil, false, false
+	}
+	return nil, false, true
+}
+
+// Entry versions are exposed as strong ETags holding the sequence number.
+func formatETag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+func parseETag(etag string) (uint64, error) {
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, fmt.Errorf("ETag `%s` is not quoted", etag)
+	}
+
+	version, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ETag `%s` is not an entry version", etag)
+	}
+	return version, nil
+}
+
 func getQueryParameter(
 	param, url string,
 	response http.ResponseWriter,
 	request *http.Request,
 ) (value string, exists bool) {
-	value = request.URL.Query().Get("key")
+	value = request.URL.Query().Get(param)
 	if value == "" {
 		logger.Warn("Malformed `%s` request - missing `%s` parameter", url, param)
 		msg := fmt.Sprintf("Missing query parameter `%s`", param)
@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestServer(t *testing.T, config AtlasServerConfig) *AtlasServer {
+	t.Helper()
+
+	if config.Engine.Lsm.Dir == "" {
+		config.Engine = testAtlasConfig(t.TempDir())
+	}
+
+	server, err := CreateAtlasServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// Serves the request and returns the response with its body read.
+func serveTestRequest(
+	server *AtlasServer,
+	method, target, body string,
+	headers map[string]string,
+) (*http.Response, string) {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.mux.ServeHTTP(recorder, request)
+
+	response := recorder.Result()
+	data, _ := io.ReadAll(response.Body)
+	return response, string(data)
+}
+
+func beginTestTransaction(t *testing.T, server *AtlasServer) string {
+	t.Helper()
+
+	response, body := serveTestRequest(server, http.MethodPost, "/v1/txn", "", nil)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("begin responded %d: %s", response.StatusCode, body)
+	}
+
+	var begin beginTxnResponse
+	if err := json.Unmarshal([]byte(body), &begin); err != nil {
+		t.Fatal(err)
+	}
+	return begin.ID
+}
+
+func TestShutdownRollsBackTransactionsInUse(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{})
+	id := beginTestTransaction(t, server)
+
+	// a commit in flight holds its transaction and then removes it
+	server.transactionsMutex.Lock()
+	serverTxn := server.transactions[id]
+	server.transactionsMutex.Unlock()
+	serverTxn.mutex.Lock()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown() }()
+	time.Sleep(50 * time.Millisecond)
+
+	removed := make(chan struct{})
+	go func() {
+		server.removeTransaction(id)
+		close(removed)
+	}()
+
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request removing its transaction deadlocked with the shutdown")
+	}
+	serverTxn.mutex.Unlock()
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	if !serverTxn.txn.isDone {
+		t.Fatal("shutdown left the transaction open")
+	}
+}
+
+func TestServerTransactionConflict(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{})
+	defer server.Shutdown()
+
+	if err := server.engine.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := beginTestTransaction(t, server)
+	response, body := serveTestRequest(server, http.MethodGet, "/v1/txn/"+id+"/atlas?key=a", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("transaction read responded %d: %s", response.StatusCode, body)
+	}
+
+	response, body = serveTestRequest(server, http.MethodPut, "/v1/txn/"+id+"/atlas?key=a&value=2", "", nil)
+	if response.StatusCode/100 != 2 {
+		t.Fatalf("transaction write responded %d: %s", response.StatusCode, body)
+	}
+
+	if err := server.engine.Insert("a", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	response, _ = serveTestRequest(server, http.MethodPost, "/v1/txn/"+id+"/commit", "", nil)
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("conflicting commit responded %d", response.StatusCode)
+	}
+
+	// the transaction is finished by the failed commit
+	response, _ = serveTestRequest(server, http.MethodPost, "/v1/txn/"+id+"/rollback", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("rollback of a finished transaction responded %d", response.StatusCode)
+	}
+	expectTestValue(t, server.engine, "a", "3")
+}
+
+func TestServerExpiresIdleTransactions(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{TransactionIdleTimeout: 50 * time.Millisecond})
+	defer server.Shutdown()
+
+	id := beginTestTransaction(t, server)
+	server.transactionsMutex.Lock()
+	txn := server.transactions[id].txn
+	server.transactionsMutex.Unlock()
+
+	// no further request arrives to trigger the expiry
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.engine.lsm.Snapshots().Sequences()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle transaction still pins its snapshot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.transactionsMutex.Lock()
+	_, exists := server.transactions[id]
+	server.transactionsMutex.Unlock()
+
+	if exists || !txn.isDone {
+		t.Fatal("idle transaction was not rolled back")
+	}
+
+	response, _ := serveTestRequest(server, http.MethodPost, "/v1/txn/"+id+"/commit", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("commit of an expired transaction responded %d", response.StatusCode)
+	}
+}
+
+func TestServerConditionalPut(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{})
+	defer server.Shutdown()
+
+	putIfAbsent := map[string]string{"If-None-Match": "*"}
+	response, body := serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=1", "", putIfAbsent)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("put of an absent key responded %d: %s", response.StatusCode, body)
+	}
+	etag := response.Header.Get("ETag")
+
+	response, _ = serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=2", "", putIfAbsent)
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("put of an existing key with `If-None-Match: *` responded %d", response.StatusCode)
+	}
+
+	response, _ = serveTestRequest(server, http.MethodGet, "/v1/atlas?key=a", "", nil)
+	if response.Header.Get("ETag") != etag {
+		t.Fatalf("read returned ETag %s, the write %s", response.Header.Get("ETag"), etag)
+	}
+
+	response, _ = serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=3", "", map[string]string{"If-Match": etag})
+	if response.StatusCode != http.StatusCreated || response.Header.Get("ETag") == etag {
+		t.Fatalf("put with the current ETag responded %d with ETag %s", response.StatusCode, response.Header.Get("ETag"))
+	}
+
+	// the ETag of the replaced version is stale
+	response, _ = serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=4", "", map[string]string{"If-Match": etag})
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("put with a stale ETag responded %d", response.StatusCode)
+	}
+
+	response, _ = serveTestRequest(server, http.MethodPut, "/v1/atlas?key=b&value=1", "", map[string]string{"If-Match": "*"})
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("put of an absent key with `If-Match: *` responded %d", response.StatusCode)
+	}
+
+	expectTestValue(t, server.engine, "a", "3")
+	expectTestValue(t, server.engine, "b", "")
+}
+
+func TestServerConditionalDelete(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{})
+	defer server.Shutdown()
+
+	response, _ := serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=1", "", map[string]string{"If-None-Match": "*"})
+	etag := response.Header.Get("ETag")
+
+	if err := server.engine.Insert("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	response, _ = serveTestRequest(server, http.MethodDelete, "/v1/atlas?key=a", "", map[string]string{"If-Match": etag})
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("delete with a stale ETag responded %d", response.StatusCode)
+	}
+	expectTestValue(t, server.engine, "a", "2")
+
+	response, _ = serveTestRequest(server, http.MethodGet, "/v1/atlas?key=a", "", nil)
+	etag = response.Header.Get("ETag")
+	response, _ = serveTestRequest(server, http.MethodDelete, "/v1/atlas?key=a", "", map[string]string{"If-Match": etag})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("delete with the current ETag responded %d", response.StatusCode)
+	}
+	expectTestValue(t, server.engine, "a", "")
+}
+
+func TestServerRejectsMalformedConditions(t *testing.T) {
+	server := createTestServer(t, AtlasServerConfig{})
+	defer server.Shutdown()
+
+	for _, headers := range []map[string]string{
+		{"If-Match": "*", "If-None-Match": "*"},
+		{"If-Match": "5"},
+		{"If-Match": `"abc"`},
+		{"If-None-Match": `"5"`},
+	} {
+		response, _ := serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=1", "", headers)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("put with %v responded %d", headers, response.StatusCode)
+		}
+	}
+	expectTestValue(t, server.engine, "a", "")
+}
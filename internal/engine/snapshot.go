@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"atlas/internal/common"
+	"sync"
+)
+
+// Consistent point-in-time view of the engine. Reads through a snapshot see
+// every write made before it was taken and none made after. The versions the
+// snapshot reads are kept by compactions until it is released.
+type Snapshot struct {
+	atlas    *Atlas
+	sequence uint64
+	release  sync.Once
+}
+
+func (atlas *Atlas) Snapshot() *Snapshot {
+	sequence := atlas.lsm.Snapshots().Acquire(atlas.visibleSequence.Load)
+	return &Snapshot{
+		atlas:    atlas,
+		sequence: sequence,
+	}
+}
+
+// Sequence of the last write seen by the snapshot.
+func (snapshot *Snapshot) Sequence() uint64 {
+	return snapshot.sequence
+}
+
+func (snapshot *Snapshot) Get(key string) (*common.Entry, bool, error) {
+	return snapshot.atlas.get(key, snapshot.sequence)
+}
+
+// Lets compactions drop the versions kept for the snapshot. Safe to call more
+// than once, the snapshot must not be read from afterwards.
+func (snapshot *Snapshot) Release() {
+	snapshot.release.Do(func() {
+		snapshot.atlas.lsm.Snapshots().Release(snapshot.sequence)
+	})
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"atlas/internal/storage"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Config which never rotates the WAL, whose syncs would be counted as well.
+func testSyncConfig(dir string, mode storage.WalSyncMode) AtlasConfig {
+	config := testAtlasConfig(dir)
+	config.Wal.MaxEntries = 1000
+	config.Wal.SegmentSize = 0
+	config.Wal.SyncMode = mode
+	config.Wal.SyncInterval = 10 * time.Millisecond
+	return config
+}
+
+func insertTestWrites(t *testing.T, atlas *Atlas, prefix string, count int, options WriteOptions) {
+	t.Helper()
+
+	batch := NewWriteBatch()
+	for idx := range count {
+		batch.Clear()
+		batch.Put(fmt.Sprintf("%s%03d", prefix, idx), "value")
+		if err := atlas.WriteWithOptions(batch, options); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestWalSyncNoneSyncsOnRequestOnly(t *testing.T) {
+	atlas := openTestAtlas(t, testSyncConfig(t.TempDir(), storage.WalSyncNone))
+	defer atlas.Close()
+
+	insertTestWrites(t, atlas, "key", 20, WriteOptions{})
+	if syncs := atlas.Stats().WalSync.Syncs; syncs != 0 {
+		t.Fatalf("%d syncs without any requested", syncs)
+	}
+
+	insertTestWrites(t, atlas, "synced", 2, WriteOptions{Sync: true})
+	if syncs := atlas.Stats().WalSync.Syncs; syncs != 2 {
+		t.Fatalf("%d syncs for 2 synced writes", syncs)
+	}
+
+	server := createTestServer(t, AtlasServerConfig{Engine: testSyncConfig(t.TempDir(), storage.WalSyncNone)})
+	defer server.Shutdown()
+
+	response, _ := serveTestRequest(server, http.MethodPut, "/v1/atlas?key=a&value=1", "", map[string]string{"X-Sync": "true"})
+	if response.StatusCode != http.StatusCreated || server.engine.Stats().WalSync.Syncs != 1 {
+		t.Fatalf("synced write responded %d after %d syncs", response.StatusCode, server.engine.Stats().WalSync.Syncs)
+	}
+}
+
+func TestWalSyncAlwaysSyncsEveryWrite(t *testing.T) {
+	atlas := openTestAtlas(t, testSyncConfig(t.TempDir(), storage.WalSyncAlways))
+	defer atlas.Close()
+
+	insertTestWrites(t, atlas, "key", 20, WriteOptions{})
+	stats := atlas.Stats().WalSync
+	if stats.Syncs != 20 || stats.MaxLatency <= 0 || stats.TotalLatency < stats.MaxLatency {
+		t.Fatalf("20 writes got %+v", stats)
+	}
+}
+
+func TestWalSyncGroupSyncsConcurrentWrites(t *testing.T) {
+	const writers = 8
+	const writes = 25
+
+	atlas := openTestAtlas(t, testSyncConfig(t.TempDir(), storage.WalSyncGroup))
+	defer atlas.Close()
+
+	var group sync.WaitGroup
+	for writer := range writers {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			insertTestWrites(t, atlas, fmt.Sprintf("w%d-", writer), writes, WriteOptions{})
+		}()
+	}
+	group.Wait()
+
+	// every write is acknowledged after a sync, which may cover several
+	if syncs := atlas.Stats().WalSync.Syncs; syncs == 0 || syncs > writers*writes {
+		t.Fatalf("%d syncs for %d writes", syncs, writers*writes)
+	}
+
+	entries, err := atlas.Scan("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != writers*writes {
+		t.Fatalf("store holds %d of %d writes", len(entries), writers*writes)
+	}
+}
+
+func TestWalSyncIntervalSyncsInBackground(t *testing.T) {
+	atlas := openTestAtlas(t, testSyncConfig(t.TempDir(), storage.WalSyncInterval))
+	defer atlas.Close()
+
+	insertTestWrites(t, atlas, "key", 5, WriteOptions{})
+
+	// synced without any further write
+	deadline := time.Now().Add(5 * time.Second)
+	for atlas.Stats().WalSync.Syncs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("WAL was not synced in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
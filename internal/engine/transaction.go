@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"atlas/internal/common"
+	"errors"
+	"fmt"
+)
+
+// Returned by `Transaction.Commit` when a key read by the transaction was
+// written by someone else after the transaction began.
+type ConflictError struct {
+	Key string
+}
+
+var ErrTransactionDone = errors.New("Transaction is already committed or rolled back")
+
+// Optimistic read-modify-write transaction. Reads see the state as of `Begin`
+// together with the transaction's own writes, which are buffered until
+// `Commit`. The commit fails with a `ConflictError` if any key read by the
+// transaction was modified in the meantime, otherwise all writes are applied
+// atomically as a single batch.
+//
+// A transaction is not safe for concurrent use.
+type Transaction struct {
+	atlas    *Atlas
+	snapshot *Snapshot
+	reads    map[string]bool
+	writes   map[string]batchOperation
+	order    []string
+	isDone   bool
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("Transaction conflict - key `%s` was modified concurrently", err.Key)
+}
+
+func (atlas *Atlas) Begin() *Transaction {
+	return &Transaction{
+		atlas:    atlas,
+		snapshot: atlas.Snapshot(),
+		reads:    make(map[string]bool),
+		writes:   make(map[string]batchOperation),
+		order:    nil,
+		isDone:   false,
+	}
+}
+
+// Sequence of the last write seen by the transaction.
+func (txn *Transaction) StartSequence() uint64 {
+	return txn.snapshot.Sequence()
+}
+
+func (txn *Transaction) Get(key string) (*common.Entry, bool, error) {
+	if txn.isDone {
+		return nil, false, ErrTransactionDone
+	}
+
+	if operation, written := txn.writes[key]; written {
+		if operation.isDelete {
+			return nil, false, nil
+		}
+		return common.NewEntry(key, operation.value), true, nil
+	}
+
+	txn.reads[key] = true
+	return txn.snapshot.Get(key)
+}
+
+func (txn *Transaction) Insert(key, value string) error {
+	return txn.bufferWrite(batchOperation{key: key, value: value})
+}
+
+func (txn *Transaction) Delete(key string) error {
+	return txn.bufferWrite(batchOperation{key: key, isDelete: true})
+}
+
+func (txn *Transaction) Commit() error {
+	if txn.isDone {
+		return ErrTransactionDone
+	}
+	defer txn.Rollback()
+
+	// reads come from a consistent snapshot, so a read-only transaction
+	// always commits
+	if len(txn.order) == 0 {
+		return nil
+	}
+
+	batch := NewWriteBatch()
+	for _, key := range txn.order {
+		batch.operations = append(batch.operations, txn.writes[key])
+	}
+
+	entries, err := batch.entries()
+	if err != nil {
+		return err
+	}
+	return txn.atlas.writeChecked(entries, txn.checkConflicts, WriteOptions{})
+}
+
+// Discards the buffered writes. Safe to call after `Commit`.
+func (txn *Transaction) Rollback() {
+	txn.isDone = true
+	txn.snapshot.Release()
+}
+
+// Runs on the writer goroutine, where the latest versions include every write
+// committed before this one.
+func (txn *Transaction) checkConflicts() error {
+	for key := range txn.reads {
+		entry, contained, err := txn.atlas.getVersion(key, common.MaxSequence)
+		if err != nil {
+			return err
+		}
+
+		if contained && entry.Sequence() > txn.snapshot.Sequence() {
+			return &ConflictError{Key: key}
+		}
+	}
+	return nil
+}
+
+func (txn *Transaction) bufferWrite(operation batchOperation) error {
+	if txn.isDone {
+		return ErrTransactionDone
+	}
+
+	if operation.key == "" {
+		return errors.New("Failed writing in transaction - empty key")
+	}
+
+	if _, written := txn.writes[operation.key]; !written {
+		txn.order = append(txn.order, operation.key)
+	}
+	txn.writes[operation.key] = operation
+	return nil
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+func expectTestTxnValue(t *testing.T, txn *Transaction, key, expected string) {
+	t.Helper()
+
+	entry, found, err := txn.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := ""
+	if found {
+		value, _ = entry.Value()
+	}
+
+	if value != expected {
+		t.Fatalf("transaction got %q for %s, expected %q", value, key, expected)
+	}
+}
+
+func TestTransactionCommitsItsWritesTogether(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	if err := atlas.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := atlas.Begin()
+	expectTestTxnValue(t, txn, "a", "1")
+	if err := txn.Insert("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Insert("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// buffered writes are seen by the transaction only
+	expectTestTxnValue(t, txn, "a", "2")
+	expectTestTxnValue(t, txn, "b", "")
+	expectTestValue(t, atlas, "a", "1")
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTestValue(t, atlas, "a", "2")
+	expectTestValue(t, atlas, "b", "")
+
+	if err := txn.Insert("c", "3"); !errors.Is(err, ErrTransactionDone) {
+		t.Fatalf("write after commit returned %v", err)
+	}
+}
+
+func TestTransactionReadsItsSnapshot(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	if err := atlas.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := atlas.Begin()
+	defer txn.Rollback()
+
+	if err := atlas.Insert("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.Insert("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTestTxnValue(t, txn, "a", "1")
+	expectTestTxnValue(t, txn, "b", "")
+}
+
+func TestTransactionConflictsWithWritesToItsReads(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	if err := atlas.Insert("counter", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := atlas.Begin()
+	expectTestTxnValue(t, txn, "counter", "1")
+	if err := txn.Insert("counter", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Insert("other", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.Insert("counter", "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	var conflict *ConflictError
+	if err := txn.Commit(); !errors.As(err, &conflict) || conflict.Key != "counter" {
+		t.Fatalf("commit returned %v", err)
+	}
+
+	// none of the writes of a conflicting transaction are applied
+	expectTestValue(t, atlas, "counter", "5")
+	expectTestValue(t, atlas, "other", "")
+
+	if err := txn.Commit(); !errors.Is(err, ErrTransactionDone) {
+		t.Fatalf("second commit returned %v", err)
+	}
+}
+
+func TestTransactionBlindWritesDoNotConflict(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	txn := atlas.Begin()
+	if err := txn.Insert("a", "txn"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.Insert("a", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectTestValue(t, atlas, "a", "txn")
+}
+
+func TestTransactionRollbackDiscardsWrites(t *testing.T) {
+	atlas := openTestAtlas(t, testAtlasConfig(t.TempDir()))
+	defer atlas.Close()
+
+	txn := atlas.Begin()
+	if err := txn.Insert("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	txn.Rollback()
+	txn.Rollback()
+
+	expectTestValue(t, atlas, "a", "")
+	if _, _, err := txn.Get("a"); !errors.Is(err, ErrTransactionDone) {
+		t.Fatalf("read after rollback returned %v", err)
+	}
+
+	if err := txn.Commit(); !errors.Is(err, ErrTransactionDone) {
+		t.Fatalf("commit after rollback returned %v", err)
+	}
+
+	// the snapshot of the transaction is released
+	if sequences := atlas.lsm.Snapshots().Sequences(); len(sequences) != 0 {
+		t.Fatalf("rolled back transaction left snapshots %v", sequences)
+	}
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiredEntriesReadAsDeleted(t *testing.T) {
+	config := testAtlasConfig(t.TempDir())
+	atlas := openTestAtlas(t, config)
+
+	if err := atlas.InsertWithTTL("a", "1", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.InsertWithTTL("b", "1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atlas.InsertWithTTL("c", "1", 0); err == nil {
+		t.Fatal("insert without a TTL succeeded")
+	}
+
+	expectTestValue(t, atlas, "a", "1")
+	if keys := collectTestKeys(t, atlas, IteratorOptions{}); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("iterator got %v", keys)
+	}
+
+	// the expiry survives the round trip through the WAL and the tables
+	if err := atlas.Close(); err != nil {
+		t.Fatal(err)
+	}
+	atlas = openTestAtlas(t, config)
+	defer atlas.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	expectTestValue(t, atlas, "a", "")
+	expectTestValue(t, atlas, "b", "1")
+	if keys := collectTestKeys(t, atlas, IteratorOptions{Reverse: true}); !slices.Equal(keys, []string{"b"}) {
+		t.Fatalf("iterator got %v", keys)
+	}
+
+	if _, err := atlas.PutIfAbsent("a", "2"); err != nil {
+		t.Fatalf("put of an expired key returned %v", err)
+	}
+	expectTestValue(t, atlas, "a", "2")
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const blockCacheShards = 16
+
+// Size bounded LRU cache of decoded SSTable data blocks, shared by all tables
+// of the LSM. The cache is split into shards with their own locks, so that
+// concurrent reads of different blocks rarely contend. Every shard holds an
+// equal part of the capacity and evicts its least recently used blocks once
+// it is exceeded.
+//
+// Blocks are keyed by the table number, which is never reused, so blocks of
+// removed tables are never read again and simply age out.
+//
+// A nil cache is valid and caches nothing.
+type BlockCache struct {
+	shards   [blockCacheShards]blockCacheShard
+	capacity uint64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type BlockCacheStats struct {
+	Capacity uint64
+	// Approximate size in bytes of the cached blocks.
+	Usage  uint64
+	Blocks int
+	Hits   uint64
+	Misses uint64
+}
+
+type blockCacheShard struct {
+	mutex    sync.Mutex
+	blocks   map[blockCacheKey]*list.Element
+	lru      *list.List
+	capacity uint64
+	usage    uint64
+}
+
+type blockCacheKey struct {
+	tableNumber uint64
+	blockIdx    int
+}
+
+type blockCacheEntry struct {
+	key     blockCacheKey
+	entries []*common.Entry
+	size    uint64
+}
+
+// Returns nil, a disabled cache, for a zero capacity.
+func NewBlockCache(capacity uint64) *BlockCache {
+	if capacity == 0 {
+		return nil
+	}
+
+	cache := &BlockCache{capacity: capacity}
+	for idx := range cache.shards {
+		cache.shards[idx] = blockCacheShard{
+			blocks:   make(map[blockCacheKey]*list.Element),
+			lru:      list.New(),
+			capacity: capacity / blockCacheShards,
+			usage:    0,
+		}
+	}
+	return cache
+}
+
+// The returned entries are shared with other readers and must not be
+// modified.
+func (cache *BlockCache) Get(tableNumber uint64, blockIdx int) ([]*common.Entry, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	key := blockCacheKey{tableNumber, blockIdx}
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	element, contained := shard.blocks[key]
+	if !contained {
+		cache.misses.Add(1)
+		return nil, false
+	}
+
+	cache.hits.Add(1)
+	shard.lru.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).entries, true
+}
+
+// Caches the decoded block, whose size is the size of its encoded contents.
+// Blocks larger than a shard are not cached.
+func (cache *BlockCache) Put(tableNumber uint64, blockIdx int, entries []*common.Entry, size uint64) {
+	if cache == nil {
+		return
+	}
+
+	key := blockCacheKey{tableNumber, blockIdx}
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if size > shard.capacity {
+		return
+	}
+
+	// a concurrent reader cached the same block first
+	if _, contained := shard.blocks[key]; contained {
+		return
+	}
+
+	shard.blocks[key] = shard.lru.PushFront(&blockCacheEntry{key, entries, size})
+	shard.usage += size
+	for shard.usage > shard.capacity {
+		oldest := shard.lru.Remove(shard.lru.Back()).(*blockCacheEntry)
+		delete(shard.blocks, oldest.key)
+		shard.usage -= oldest.size
+	}
+}
+
+func (cache *BlockCache) Stats() BlockCacheStats {
+	if cache == nil {
+		return BlockCacheStats{}
+	}
+
+	stats := BlockCacheStats{
+		Capacity: cache.capacity,
+		Hits:     cache.hits.Load(),
+		Misses:   cache.misses.Load(),
+	}
+	for idx := range cache.shards {
+		shard := &cache.shards[idx]
+		shard.mutex.Lock()
+		stats.Usage += shard.usage
+		stats.Blocks += len(shard.blocks)
+		shard.mutex.Unlock()
+	}
+	return stats
+}
+
+func (cache *BlockCache) shard(key blockCacheKey) *blockCacheShard {
+	// blocks of a table are spread over consecutive shards
+	hash := key.tableNumber*0x9e3779b97f4a7c15 + uint64(key.blockIdx)
+	return &cache.shards[hash%blockCacheShards]
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"sync"
+	"testing"
+)
+
+func TestBlockCacheGetAndPut(t *testing.T) {
+	cache := NewBlockCache(16 * 1024)
+	if _, found := cache.Get(1, 0); found {
+		t.Fatal("empty cache returned a block")
+	}
+
+	entries := []*common.Entry{common.NewEntry("key", "value")}
+	cache.Put(1, 0, entries, 100)
+
+	cached, found := cache.Get(1, 0)
+	if !found || len(cached) != 1 || cached[0].Key() != "key" {
+		t.Fatalf("got %v, %t for a cached block", cached, found)
+	}
+
+	if _, found := cache.Get(2, 0); found {
+		t.Fatal("cache returned the block of another table")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Blocks != 1 || stats.Usage != 100 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// a single block fits in a shard, a second one of the same table and shard
+	// evicts the least recently used
+	cache := NewBlockCache(blockCacheShards * 100)
+	entries := []*common.Entry{common.NewEntry("key", "value")}
+
+	cache.Put(1, 0, entries, 60)
+	cache.Put(1, blockCacheShards, entries, 60)
+
+	if _, found := cache.Get(1, 0); found {
+		t.Fatal("least recently used block was not evicted")
+	}
+
+	if _, found := cache.Get(1, blockCacheShards); !found {
+		t.Fatal("most recently used block was evicted")
+	}
+
+	if stats := cache.Stats(); stats.Usage > stats.Capacity {
+		t.Fatalf("usage %d exceeds capacity %d", stats.Usage, stats.Capacity)
+	}
+}
+
+func TestBlockCacheSkipsBlocksLargerThanAShard(t *testing.T) {
+	cache := NewBlockCache(blockCacheShards * 100)
+	cache.Put(1, 0, []*common.Entry{common.NewEntry("key", "value")}, 101)
+
+	if _, found := cache.Get(1, 0); found {
+		t.Fatal("block larger than a shard was cached")
+	}
+}
+
+func TestNilBlockCacheCachesNothing(t *testing.T) {
+	cache := NewBlockCache(0)
+	if cache != nil {
+		t.Fatal("zero capacity cache is not nil")
+	}
+
+	cache.Put(1, 0, []*common.Entry{common.NewEntry("key", "value")}, 10)
+	if _, found := cache.Get(1, 0); found {
+		t.Fatal("nil cache returned a block")
+	}
+
+	if stats := cache.Stats(); stats != (BlockCacheStats{}) {
+		t.Fatalf("nil cache has stats %+v", stats)
+	}
+}
+
+func TestBlockCacheConcurrentAccess(t *testing.T) {
+	cache := NewBlockCache(4 * 1024)
+	entries := []*common.Entry{common.NewEntry("key", "value")}
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range 1000 {
+				table := uint64(worker*1000 + idx%50)
+				if _, found := cache.Get(table, idx%7); !found {
+					cache.Put(table, idx%7, entries, 64)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats := cache.Stats(); stats.Usage > stats.Capacity {
+		t.Fatalf("usage %d exceeds capacity %d", stats.Usage, stats.Capacity)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+const maxBloomHashCount = 30
+
+// Probabilistic set of keys with no false negatives. Probes are derived from a
+// single 64 bit hash through double hashing.
+type BloomFilter struct {
+	bits      []byte
+	hashCount uint8
+}
+
+type bloomFilterBuilder struct {
+	bitsPerKey int
+	hashes     []uint64
+}
+
+func newBloomFilterBuilder(bitsPerKey int) *bloomFilterBuilder {
+	return &bloomFilterBuilder{
+		bitsPerKey: bitsPerKey,
+		hashes:     nil,
+	}
+}
+
+func (builder *bloomFilterBuilder) Add(key string) {
+	builder.hashes = append(builder.hashes, bloomHash(key))
+}
+
+func (builder *bloomFilterBuilder) Build() *BloomFilter {
+	bitCount := max(len(builder.hashes)*builder.bitsPerKey, 64)
+	byteCount := (bitCount + 7) / 8
+
+	hashCount := int(float64(builder.bitsPerKey) * math.Ln2)
+	hashCount = min(max(hashCount, 1), maxBloomHashCount)
+
+	filter := &BloomFilter{
+		bits:      make([]byte, byteCount),
+		hashCount: uint8(hashCount),
+	}
+	for _, hash := range builder.hashes {
+		filter.forEachProbe(hash, func(bit uint64) bool {
+			filter.bits[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return filter
+}
+
+func (filter *BloomFilter) MayContain(key string) bool {
+	result := true
+	filter.forEachProbe(bloomHash(key), func(bit uint64) bool {
+		result = filter.bits[bit/8]&(1<<(bit%8)) != 0
+		return result
+	})
+	return result
+}
+
+// Layout: the bit array followed by a single byte holding the hash count.
+func (filter *BloomFilter) Encode() []byte {
+	encoded := make([]byte, 0, len(filter.bits)+1)
+	encoded = append(encoded, filter.bits...)
+	return append(encoded, filter.hashCount)
+}
+
+func DecodeBloomFilter(encoded []byte) (*BloomFilter, error) {
+	if len(encoded) < 2 {
+		return nil, errors.New("Failed decoding bloom filter - filter is too short")
+	}
+
+	hashCount := encoded[len(encoded)-1]
+	if hashCount == 0 || hashCount > maxBloomHashCount {
+		return nil, errors.New("Failed decoding bloom filter - invalid hash count")
+	}
+
+	return &BloomFilter{
+		bits:      encoded[:len(encoded)-1],
+		hashCount: hashCount,
+	}, nil
+}
+
+func (filter *BloomFilter) forEachProbe(hash uint64, probe func(bit uint64) bool) {
+	bitCount := uint64(len(filter.bits)) * 8
+	delta := hash>>33 | hash<<31
+	for range filter.hashCount {
+		if !probe(hash % bitCount) {
+			return
+		}
+		hash += delta
+	}
+}
+
+func bloomHash(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return hasher.Sum64()
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	builder := newBloomFilterBuilder(10)
+	for idx := range 1000 {
+		builder.Add(fmt.Sprintf("key%04d", idx))
+	}
+	filter := builder.Build()
+
+	for idx := range 1000 {
+		key := fmt.Sprintf("key%04d", idx)
+		if !filter.MayContain(key) {
+			t.Fatalf("filter rules out added key %s", key)
+		}
+	}
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	builder := newBloomFilterBuilder(10)
+	for idx := range 1000 {
+		builder.Add(fmt.Sprintf("key%04d", idx))
+	}
+	filter := builder.Build()
+
+	falsePositives := 0
+	for idx := range 10000 {
+		if filter.MayContain(fmt.Sprintf("absent%05d", idx)) {
+			falsePositives += 1
+		}
+	}
+
+	// about 1% is expected at 10 bits per key
+	if falsePositives > 300 {
+		t.Fatalf("got %d false positives out of 10000 lookups", falsePositives)
+	}
+}
+
+func TestBloomFilterEncodingRoundTrip(t *testing.T) {
+	builder := newBloomFilterBuilder(8)
+	builder.Add("a")
+	builder.Add("b")
+	filter := builder.Build()
+
+	decoded, err := DecodeBloomFilter(filter.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.hashCount != filter.hashCount || string(decoded.bits) != string(filter.bits) {
+		t.Fatal("decoded filter differs from the encoded one")
+	}
+
+	if !decoded.MayContain("a") || !decoded.MayContain("b") {
+		t.Fatal("decoded filter rules out added keys")
+	}
+}
+
+func TestDecodeBloomFilterRejectsInvalidFilters(t *testing.T) {
+	for _, encoded := range [][]byte{
+		nil,
+		{0},
+		{0xff, 0},
+		{0xff, maxBloomHashCount + 1},
+	} {
+		if _, err := DecodeBloomFilter(encoded); err == nil {
+			t.Fatalf("decoding %v succeeded", encoded)
+		}
+	}
+}
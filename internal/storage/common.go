@@ -2,48 +2,103 @@ package storage
 
 import (
 	"atlas/internal/common"
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"os"
+	"syscall"
 )
 
-func getFileEntries(file *os.File, entryIndex []int64) ([]*common.Entry, error) {
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
+// Every WAL and SSTable file starts with an 8 byte magic followed by the
+// version of its format. Files in the text format written before have no
+// header.
+const fileHeaderSize = 9
+
+var (
+	walMagic     = []byte("ATLASWAL")
+	sstableMagic = []byte("ATLASSST")
+)
 
-	result, err := getEntriesFromCurrentFileOffset(file, entryIndex)
+func writeFileHeader(file *os.File, magic []byte, version byte) error {
+	header := append(bytes.Clone(magic), version)
+	written, err := file.Write(header)
 	if err != nil {
-		if _, err := file.Seek(0, io.SeekEnd); err != nil {
-			return nil, err
-		}
+		return err
+	}
 
+	if written < len(header) {
+		return errors.New("Failed writing file header - partially written header")
 	}
-	return result, nil
+	return nil
 }
 
-func getEntriesFromCurrentFileOffset(file *os.File, entryIndex []int64) ([]*common.Entry, error) {
-	if len(entryIndex) == 0 {
-		return []*common.Entry{}, nil
+// Returns the version stored in the file header, reporting whether the file
+// starts with a valid header at all. Files written before the binary encoding
+// have no header.
+func readFileHeader(file *os.File, magic []byte, maxVersion byte) (byte, bool, error) {
+	header := make([]byte, fileHeaderSize)
+	read, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+
+	if read < fileHeaderSize || !bytes.Equal(header[:len(magic)], magic) {
+		return 0, false, nil
+	}
+
+	version := header[len(magic)]
+	if version > maxVersion {
+		return 0, false, errors.New("Failed reading file header - unsupported version")
 	}
+	return version, true, nil
+}
 
-	entryIndex = append([]int64{0}, entryIndex...)
+// Reads the entries of a file in the `key|value` text format written before
+// the binary encoding, one entry per line. A partial last line is a torn write
+// and is discarded.
+func readLegacyEntries(filename string) ([]*common.Entry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	var result []*common.Entry = nil
-	for i, offset := range entryIndex[1:] {
-		prevOffset := entryIndex[i]
+	var entries []*common.Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logger.Warn("Discarding partially written entry in %s", filename)
+			}
+			return entries, nil
+		}
 
-		bufferSize := offset - prevOffset
-		buffer := make([]byte, bufferSize)
-		if _, err := file.Read(buffer); err != nil {
+		if err != nil {
 			return nil, err
 		}
 
-		entry, err := common.DeserializeEntry(string(buffer))
+		if len(bytes.TrimSpace([]byte(line))) == 0 {
+			continue
+		}
+
+		entry, err := common.DeserializeLegacyEntry(line)
 		if err != nil {
 			return nil, err
 		}
+		entries = append(entries, entry)
+	}
+}
 
-		result = append(result, entry)
+// Hard links the file, or copies it when the target is on another file system.
+func linkFile(source, target string) error {
+	err := os.Link(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
 	}
-	return result, nil
+
+	return utils.CopyFile(source, target, defaultFilePermission)
 }
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"errors"
+	"slices"
+	"strings"
+)
+
+type compaction struct {
+	level       int
+	outputLevel int
+	inputs      []*SSTable
+	overlapping []*SSTable
+}
+
+// Compacts levels until every one of them fits in its budget. The last level
+// has no budget since there is nowhere to push its tables to.
+//
+// Compactions run on the goroutine doing the flushes, the only one modifying
+// the levels, so the levels are read without locking here.
+func (lsm *Lsm) compact() error {
+	for {
+		level, found := lsm.pickLevelToCompact()
+		if !found {
+			return nil
+		}
+
+		compaction := lsm.pickCompactionInputs(level)
+		if err := lsm.runCompaction(compaction); err != nil {
+			return err
+		}
+
+		// a single level tree is rewritten in place, which does not shrink it
+		if compaction.outputLevel == compaction.level {
+			return nil
+		}
+	}
+}
+
+// Runs the compactions due, for instance after a flush whose table was
+// installed before a compaction failed. Must not run concurrently with flushes.
+func (lsm *Lsm) Compact() error {
+	return lsm.compact()
+}
+
+func (lsm *Lsm) pickLevelToCompact() (int, bool) {
+	for level := range lsm.levels {
+		isLast := level == len(lsm.levels)-1
+		if isLast && (level != 0 || len(lsm.levels[0]) <= 1) {
+			continue
+		}
+
+		if lsm.isLevelOverBudget(level) {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+func (lsm *Lsm) isLevelOverBudget(level int) bool {
+	config := lsm.config.Levels[level]
+	tables := lsm.levels[level]
+	if config.MaxTables > 0 && len(tables) > config.MaxTables {
+		return true
+	}
+
+	if config.MaxSize == 0 {
+		return false
+	}
+
+	var size uint64 = 0
+	for _, table := range tables {
+		size += table.Size()
+	}
+	return size > config.MaxSize
+}
+
+// Tables in the first level may overlap, so all of them are compacted at once.
+// For the other levels a single table is picked, rotating through the key space
+// so that every table gets pushed down eventually.
+func (lsm *Lsm) pickCompactionInputs(level int) *compaction {
+	outputLevel := min(level+1, len(lsm.levels)-1)
+
+	var inputs []*SSTable
+	if level == 0 {
+		inputs = slices.Clone(lsm.levels[0])
+	} else {
+		tables := lsm.levels[level]
+		pointer := lsm.compactPointers[level]
+		idx := slices.IndexFunc(tables, func(table *SSTable) bool {
+			return table.minKey > pointer
+		})
+		if idx < 0 {
+			idx = 0
+		}
+
+		inputs = []*SSTable{tables[idx]}
+		lsm.compactPointers[level] = tables[idx].maxKey
+	}
+
+	var overlapping []*SSTable
+	if outputLevel != level {
+		minKey, maxKey := getKeyRange(inputs)
+		for _, table := range lsm.levels[outputLevel] {
+			if table.maxKey >= minKey && table.minKey <= maxKey {
+				overlapping = append(overlapping, table)
+			}
+		}
+	}
+
+	return &compaction{
+		level:       level,
+		outputLevel: outputLevel,
+		inputs:      inputs,
+		overlapping: overlapping,
+	}
+}
+
+func (lsm *Lsm) runCompaction(compaction *compaction) error {
+	// sources are ordered from the newest to the oldest, which breaks ties
+	// between entries without a sequence
+	var sources []EntryIterator
+	for idx := len(compaction.inputs) - 1; idx >= 0; idx-- {
+		sources = append(sources, compaction.inputs[idx].iterator(false))
+	}
+	for _, table := range compaction.overlapping {
+		sources = append(sources, table.iterator(false))
+	}
+
+	// tombstones have nothing left to shadow in the last level, unless a
+	// snapshot still reads the versions below them
+	dropTombstones := compaction.outputLevel == len(lsm.levels)-1
+	filter := newVersionFilter(lsm.snapshots.Sequences(), dropTombstones)
+
+	merged := NewMergingIterator(sources)
+	outputs, err := lsm.writeMergedTables(merged, filter, compaction.outputLevel)
+	if err != nil {
+		return err
+	}
+
+	if err := lsm.installCompaction(compaction, outputs); err != nil {
+		discardTables(outputs, err)
+		return err
+	}
+
+	logger.Info(
+		"Compacted %d tables from level %d with %d tables from level %d into %d tables",
+		len(compaction.inputs), compaction.level,
+		len(compaction.overlapping), compaction.outputLevel,
+		len(outputs),
+	)
+	return nil
+}
+
+func (lsm *Lsm) writeMergedTables(
+	merged *MergingIterator,
+	filter *versionFilter,
+	outputLevel int,
+) ([]*SSTable, error) {
+	maxFileSize := lsm.config.Levels[outputLevel].MaxFileSize
+
+	var outputs []*SSTable
+	var builder *SSTableBuilder = nil
+	var lastKey string
+	abort := func() {
+		if builder != nil {
+			builder.Abort()
+		}
+		for _, table := range outputs {
+			table.Remove()
+		}
+	}
+
+	var err error
+	for err = merged.SeekToFirst(); err == nil && merged.Valid(); err = merged.Next() {
+		entry := merged.Entry()
+		if !filter.keep(entry) {
+			continue
+		}
+
+		// the versions of a key are never split between tables, so that
+		// the key ranges of the tables in a level do not overlap
+		isFull := builder != nil && maxFileSize > 0 && builder.Size() >= maxFileSize
+		if isFull && entry.Key() != lastKey {
+			table, err := builder.Build()
+			if err != nil {
+				abort()
+				return nil, err
+			}
+
+			outputs = append(outputs, table)
+			builder = nil
+		}
+
+		if builder == nil {
+			builder, err = NewSSTableBuilder(
+				lsm.getNewSSTableFilename(outputLevel),
+				lsm.config.tableOptions(),
+			)
+			if err != nil {
+				abort()
+				return nil, err
+			}
+		}
+
+		if err := builder.AddSorted(entry); err != nil {
+			abort()
+			return nil, err
+		}
+		lastKey = entry.Key()
+	}
+
+	if err != nil {
+		abort()
+		return nil, err
+	}
+
+	if builder != nil && builder.Count() > 0 {
+		table, err := builder.Build()
+		if err != nil {
+			abort()
+			return nil, err
+		}
+		outputs = append(outputs, table)
+	}
+
+	if err := utils.SyncDir(lsm.getLevelDir(outputLevel)); err != nil {
+		abort()
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// Records the compaction in the manifest and swaps the compacted tables for
+// the new ones in a single step. The obsolete tables are removed once no
+// version references them anymore.
+func (lsm *Lsm) installCompaction(compaction *compaction, outputs []*SSTable) error {
+	obsolete := append(slices.Clone(compaction.inputs), compaction.overlapping...)
+
+	edit := &versionEdit{
+		NextFileNumber: lsm.nextFileNumber,
+		LastSequence:   lsm.lastSequence,
+	}
+	for _, table := range outputs {
+		edit.Added = append(edit.Added, newTableMetadata(compaction.outputLevel, table))
+	}
+	for _, table := range compaction.inputs {
+		edit.Removed = append(edit.Removed, newTableMetadata(compaction.level, table))
+	}
+	for _, table := range compaction.overlapping {
+		edit.Removed = append(edit.Removed, newTableMetadata(compaction.outputLevel, table))
+	}
+
+	if err := lsm.manifest.Append(edit); err != nil {
+		return err
+	}
+
+	isObsolete := func(table *SSTable) bool {
+		return slices.Contains(obsolete, table)
+	}
+
+	levels := slices.Clone(lsm.levels)
+	levels[compaction.level] = slices.DeleteFunc(
+		slices.Clone(levels[compaction.level]), isObsolete,
+	)
+
+	outputLevel := slices.DeleteFunc(
+		slices.Clone(levels[compaction.outputLevel]), isObsolete,
+	)
+	outputLevel = append(outputLevel, outputs...)
+	if compaction.outputLevel > 0 {
+		slices.SortFunc(outputLevel, compareTableRanges)
+	}
+	levels[compaction.outputLevel] = outputLevel
+
+	lsm.installVersion(levels, obsolete, lsm.lastSequence)
+
+	lsm.removeObsoleteTables()
+	return nil
+}
+
+// Removes the tables of an edit which failed to be recorded. The tables of an
+// edit which may be in the manifest are only closed, since the next open
+// might find them live.
+func discardTables(tables []*SSTable, err error) {
+	for _, table := range tables {
+		if errors.Is(err, ErrManifestEditUnknown) {
+			table.Close()
+		} else {
+			table.Remove()
+		}
+	}
+}
+
+func getKeyRange(tables []*SSTable) (minKey, maxKey string) {
+	for idx, table := range tables {
+		if idx == 0 || table.minKey < minKey {
+			minKey = table.minKey
+		}
+
+		if idx == 0 || table.maxKey > maxKey {
+			maxKey = table.maxKey
+		}
+	}
+	return
+}
+
+func compareTableRanges(t1, t2 *SSTable) int {
+	return strings.Compare(t1.minKey, t2.minKey)
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testLsmConfig(t *testing.T) LsmConfig {
+	return LsmConfig{
+		Dir: filepath.Join(t.TempDir(), "lsm"),
+		Levels: []LsmLevelConfig{
+			{MaxFileSize: 1024, MaxTables: 2},
+			{MaxFileSize: 1024, MaxTables: 4},
+			{MaxFileSize: 1024},
+		},
+		BlockSize:             256,
+		BloomBitsPerKey:       10,
+		ObsoleteSweepInterval: time.Hour,
+	}
+}
+
+// Flushes a memtable with a version of every key, whose value is the key and
+// its sequence, taking the sequences after the given one in order.
+func flushTestEntries(t *testing.T, lsm *Lsm, sequence uint64, keys ...string) {
+	t.Helper()
+
+	memtable := NewMemtable()
+	for _, key := range keys {
+		sequence += 1
+		entry := common.NewEntry(key, fmt.Sprintf("%s-%d", key, sequence))
+		entry.SetSequence(sequence)
+		if err := memtable.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestMemtable(t, lsm, memtable)
+}
+
+func flushTestMemtable(t *testing.T, lsm *Lsm, memtable *Memtable) {
+	t.Helper()
+
+	memtable.Freeze()
+	if err := lsm.Flush(memtable); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectTestValue(t *testing.T, lsm *Lsm, key, expected string) {
+	t.Helper()
+	expectTestValueAt(t, lsm, key, common.MaxSequence, expected)
+}
+
+// An empty expected value expects the key to be absent or deleted.
+func expectTestValueAt(t *testing.T, lsm *Lsm, key string, sequence uint64, expected string) {
+	t.Helper()
+
+	entry, found, err := lsm.Get(key, sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := ""
+	if found && !entry.IsDead() {
+		value, _ = entry.Value()
+	}
+
+	if value != expected {
+		t.Fatalf("got %q for %s at sequence %d, expected %q", value, key, sequence, expected)
+	}
+}
+
+func TestCompactionKeepsLevelsWithinBudget(t *testing.T) {
+	config := testLsmConfig(t)
+	config.Levels[1].MaxTables = 1
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	var sequence uint64
+	for batch := range 20 {
+		var keys []string
+		for idx := range 20 {
+			keys = append(keys, fmt.Sprintf("key%03d", (batch*7+idx)%60))
+		}
+		flushTestEntries(t, lsm, sequence, keys...)
+		sequence += uint64(len(keys))
+	}
+
+	for level, config := range lsm.config.Levels[:len(lsm.levels)-1] {
+		if len(lsm.levels[level]) > config.MaxTables {
+			t.Fatalf("level %d holds %d tables", level, len(lsm.levels[level]))
+		}
+	}
+
+	if len(lsm.levels[len(lsm.levels)-1]) == 0 {
+		t.Fatal("nothing was compacted into the last level")
+	}
+
+	// tables below the first level must not overlap
+	for level, tables := range lsm.levels[1:] {
+		for idx := 1; idx < len(tables); idx++ {
+			if tables[idx-1].maxKey >= tables[idx].minKey {
+				t.Fatalf("tables of level %d overlap", level+1)
+			}
+		}
+	}
+
+	// the newest version of every key wins
+	latest := make(map[string]uint64)
+	sequence = 0
+	for batch := range 20 {
+		for idx := range 20 {
+			sequence += 1
+			latest[fmt.Sprintf("key%03d", (batch*7+idx)%60)] = sequence
+		}
+	}
+
+	for key, keySequence := range latest {
+		expectTestValue(t, lsm, key, fmt.Sprintf("%s-%d", key, keySequence))
+	}
+}
+
+func TestCompactionDropsShadowedVersionsAndTombstones(t *testing.T) {
+	config := testLsmConfig(t)
+	config.Levels = []LsmLevelConfig{{MaxFileSize: 1024, MaxTables: 1}, {MaxFileSize: 1024}}
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	flushTestEntries(t, lsm, 0, "a", "b")
+
+	memtable := NewMemtable()
+	tombstone := common.NewEmptyEntry("a")
+	tombstone.SetSequence(3)
+	if err := memtable.Put(tombstone); err != nil {
+		t.Fatal(err)
+	}
+	flushTestMemtable(t, lsm, memtable)
+
+	if len(lsm.levels[0]) != 0 || len(lsm.levels[1]) != 1 {
+		t.Fatalf("tables were not compacted into the last level: %d, %d", len(lsm.levels[0]), len(lsm.levels[1]))
+	}
+
+	entries, err := lsm.levels[1][0].Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Key() != "b" {
+		t.Fatalf("last level holds %v", entries)
+	}
+	expectTestValue(t, lsm, "a", "")
+	expectTestValue(t, lsm, "b", "b-2")
+}
+
+func TestCompactionDropsExpiredEntries(t *testing.T) {
+	config := testLsmConfig(t)
+	config.Levels = []LsmLevelConfig{{MaxFileSize: 1024, MaxTables: 1}, {MaxFileSize: 1024}}
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	memtable := NewMemtable()
+	for idx, entry := range []*common.Entry{
+		common.NewEntryWithTTL("a", "a", time.Millisecond),
+		common.NewEntryWithTTL("b", "b", time.Hour),
+	} {
+		entry.SetSequence(uint64(idx + 1))
+		if err := memtable.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	flushTestMemtable(t, lsm, memtable)
+	flushTestEntries(t, lsm, 3, "c")
+
+	if len(lsm.levels[0]) != 0 || len(lsm.levels[1]) != 1 {
+		t.Fatalf("tables were not compacted into the last level: %d, %d", len(lsm.levels[0]), len(lsm.levels[1]))
+	}
+
+	entries, err := lsm.levels[1][0].Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Key() != "b" || entries[1].Key() != "c" {
+		t.Fatalf("last level holds %v", entries)
+	}
+}
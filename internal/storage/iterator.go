@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"cmp"
+	"sort"
+)
+
+// Ordered cursor over entries in the order of `common.CompareVersions`. An
+// iterator moved past either end is no longer valid. Positioning may need to
+// read from disk, hence the errors.
+type EntryIterator interface {
+	Valid() bool
+	Entry() *common.Entry
+	SeekToFirst() error
+	SeekToLast() error
+	// Positions the iterator at the newest version of the first key greater
+	// or equal to the given one.
+	Seek(key string) error
+	// Positions the iterator at the oldest version of the last key less or
+	// equal to the given one.
+	SeekForPrev(key string) error
+	Next() error
+	Prev() error
+}
+
+// Merges several iterators into a single stream of every version in the order
+// of `common.CompareVersions`. Identical versions are ordered by their sources,
+// which are expected from the newest to the oldest.
+type MergingIterator struct {
+	sources    []EntryIterator
+	currentIdx int
+	reverse    bool
+}
+
+// Presents the newest version of every key visible at the sequence, hiding the
+// newer writes and the older versions. Tombstones are returned like any other
+// entry. The iterator moves in the direction of the last positioning: forwards
+// with `Next` after `SeekToFirst` or `Seek`, backwards with `Prev` after
+// `SeekToLast` or `SeekForPrev`.
+type SnapshotIterator struct {
+	merged   *MergingIterator
+	sequence uint64
+	current  *common.Entry
+}
+
+// Iterates the tables of a level whose key ranges do not overlap as if they
+// were a single table.
+type levelIterator struct {
+	tables   []*SSTable
+	tableIdx int
+	iter     *SSTableIterator
+}
+
+func NewMergingIterator(sources []EntryIterator) *MergingIterator {
+	return &MergingIterator{
+		sources:    sources,
+		currentIdx: -1,
+		reverse:    false,
+	}
+}
+
+func (iter *MergingIterator) Valid() bool {
+	return iter.currentIdx >= 0
+}
+
+func (iter *MergingIterator) Entry() *common.Entry {
+	return iter.sources[iter.currentIdx].Entry()
+}
+
+func (iter *MergingIterator) SeekToFirst() error {
+	return iter.positionSources(false, EntryIterator.SeekToFirst)
+}
+
+func (iter *MergingIterator) SeekToLast() error {
+	return iter.positionSources(true, EntryIterator.SeekToLast)
+}
+
+func (iter *MergingIterator) Seek(key string) error {
+	return iter.positionSources(false, func(source EntryIterator) error {
+		return source.Seek(key)
+	})
+}
+
+func (iter *MergingIterator) SeekForPrev(key string) error {
+	return iter.positionSources(true, func(source EntryIterator) error {
+		return source.SeekForPrev(key)
+	})
+}
+
+func (iter *MergingIterator) Next() error {
+	// after moving backwards the other sources are positioned before the
+	// current entry, they are moved past it first
+	if iter.reverse {
+		current, currentIdx := iter.Entry(), iter.currentIdx
+		for idx, source := range iter.sources {
+			if idx == currentIdx {
+				continue
+			}
+
+			if err := source.Seek(current.Key()); err != nil {
+				return err
+			}
+
+			for source.Valid() && compareSourceEntries(source.Entry(), idx, current, currentIdx) < 0 {
+				if err := source.Next(); err != nil {
+					return err
+				}
+			}
+		}
+		iter.reverse = false
+	}
+
+	if err := iter.sources[iter.currentIdx].Next(); err != nil {
+		return err
+	}
+	iter.pickCurrent()
+	return nil
+}
+
+func (iter *MergingIterator) Prev() error {
+	if !iter.reverse {
+		current, currentIdx := iter.Entry(), iter.currentIdx
+		for idx, source := range iter.sources {
+			if idx == currentIdx {
+				continue
+			}
+
+			if err := source.SeekForPrev(current.Key()); err != nil {
+				return err
+			}
+
+			for source.Valid() && compareSourceEntries(source.Entry(), idx, current, currentIdx) > 0 {
+				if err := source.Prev(); err != nil {
+					return err
+				}
+			}
+		}
+		iter.reverse = true
+	}
+
+	if err := iter.sources[iter.currentIdx].Prev(); err != nil {
+		return err
+	}
+	iter.pickCurrent()
+	return nil
+}
+
+func (iter *MergingIterator) positionSources(reverse bool, position func(EntryIterator) error) error {
+	iter.currentIdx = -1
+	iter.reverse = reverse
+	for _, source := range iter.sources {
+		if err := position(source); err != nil {
+			return err
+		}
+	}
+	iter.pickCurrent()
+	return nil
+}
+
+// Picks the source holding the next entry in the direction of the iteration.
+func (iter *MergingIterator) pickCurrent() {
+	iter.currentIdx = -1
+	for idx, source := range iter.sources {
+		if !source.Valid() {
+			continue
+		}
+
+		if iter.currentIdx < 0 {
+			iter.currentIdx = idx
+			continue
+		}
+
+		current := iter.sources[iter.currentIdx].Entry()
+		order := compareSourceEntries(source.Entry(), idx, current, iter.currentIdx)
+		if iter.reverse {
+			order = -order
+		}
+
+		if order < 0 {
+			iter.currentIdx = idx
+		}
+	}
+}
+
+func compareSourceEntries(e1 *common.Entry, idx1 int, e2 *common.Entry, idx2 int) int {
+	if result := common.CompareVersions(e1, e2); result != 0 {
+		return result
+	}
+	return cmp.Compare(idx1, idx2)
+}
+
+func NewSnapshotIterator(merged *MergingIterator, sequence uint64) *SnapshotIterator {
+	return &SnapshotIterator{
+		merged:   merged,
+		sequence: sequence,
+		current:  nil,
+	}
+}
+
+func (iter *SnapshotIterator) Valid() bool {
+	return iter.current != nil
+}
+
+func (iter *SnapshotIterator) Entry() *common.Entry {
+	return iter.current
+}
+
+func (iter *SnapshotIterator) SeekToFirst() error {
+	if err := iter.merged.SeekToFirst(); err != nil {
+		return err
+	}
+	return iter.findNextVisible()
+}
+
+func (iter *SnapshotIterator) Seek(key string) error {
+	if err := iter.merged.Seek(key); err != nil {
+		return err
+	}
+	return iter.findNextVisible()
+}
+
+func (iter *SnapshotIterator) Next() error {
+	key := iter.current.Key()
+	for iter.merged.Valid() && iter.merged.Entry().Key() == key {
+		if err := iter.merged.Next(); err != nil {
+			return err
+		}
+	}
+	return iter.findNextVisible()
+}
+
+func (iter *SnapshotIterator) SeekToLast() error {
+	if err := iter.merged.SeekToLast(); err != nil {
+		return err
+	}
+	return iter.findPrevVisible()
+}
+
+func (iter *SnapshotIterator) SeekForPrev(key string) error {
+	if err := iter.merged.SeekForPrev(key); err != nil {
+		return err
+	}
+	return iter.findPrevVisible()
+}
+
+// Moving backwards leaves the merged iterator positioned at the previous key
+// already.
+func (iter *SnapshotIterator) Prev() error {
+	return iter.findPrevVisible()
+}
+
+// Versions of a key come from the newest to the oldest, so the first visible
+// one is the newest.
+func (iter *SnapshotIterator) findNextVisible() error {
+	for iter.merged.Valid() {
+		if entry := iter.merged.Entry(); entry.Sequence() <= iter.sequence {
+			iter.current = entry
+			return nil
+		}
+
+		if err := iter.merged.Next(); err != nil {
+			return err
+		}
+	}
+	iter.current = nil
+	return nil
+}
+
+// Going backwards the versions of a key come from the oldest to the newest, so
+// all of them are consumed to find the newest visible one.
+func (iter *SnapshotIterator) findPrevVisible() error {
+	for iter.merged.Valid() {
+		key := iter.merged.Entry().Key()
+		var visible *common.Entry = nil
+		for iter.merged.Valid() && iter.merged.Entry().Key() == key {
+			if entry := iter.merged.Entry(); entry.Sequence() <= iter.sequence {
+				visible = entry
+			}
+
+			if err := iter.merged.Prev(); err != nil {
+				return err
+			}
+		}
+
+		if visible != nil {
+			iter.current = visible
+			return nil
+		}
+	}
+	iter.current = nil
+	return nil
+}
+
+func newLevelIterator(tables []*SSTable) *levelIterator {
+	return &levelIterator{
+		tables:   tables,
+		tableIdx: -1,
+		iter:     nil,
+	}
+}
+
+func (iter *levelIterator) Valid() bool {
+	return iter.iter != nil && iter.iter.Valid()
+}
+
+func (iter *levelIterator) Entry() *common.Entry {
+	return iter.iter.Entry()
+}
+
+func (iter *levelIterator) SeekToFirst() error {
+	if !iter.openTable(0) {
+		return nil
+	}
+	return iter.iter.SeekToFirst()
+}
+
+func (iter *levelIterator) SeekToLast() error {
+	if !iter.openTable(len(iter.tables) - 1) {
+		return nil
+	}
+	return iter.iter.SeekToLast()
+}
+
+func (iter *levelIterator) Seek(key string) error {
+	tableIdx := sort.Search(len(iter.tables), func(idx int) bool {
+		return iter.tables[idx].maxKey >= key
+	})
+	if !iter.openTable(tableIdx) {
+		return nil
+	}
+	return iter.iter.Seek(key)
+}
+
+func (iter *levelIterator) SeekForPrev(key string) error {
+	tableIdx := sort.Search(len(iter.tables), func(idx int) bool {
+		return iter.tables[idx].minKey > key
+	})
+	if !iter.openTable(tableIdx - 1) {
+		return nil
+	}
+	return iter.iter.SeekForPrev(key)
+}
+
+func (iter *levelIterator) Next() error {
+	if err := iter.iter.Next(); err != nil {
+		return err
+	}
+
+	if iter.iter.Valid() || !iter.openTable(iter.tableIdx+1) {
+		return nil
+	}
+	return iter.iter.SeekToFirst()
+}
+
+func (iter *levelIterator) Prev() error {
+	if err := iter.iter.Prev(); err != nil {
+		return err
+	}
+
+	if iter.iter.Valid() || !iter.openTable(iter.tableIdx-1) {
+		return nil
+	}
+	return iter.iter.SeekToLast()
+}
+
+// Reports whether the index points to a table, opening an iterator over it.
+func (iter *levelIterator) openTable(tableIdx int) bool {
+	iter.tableIdx = tableIdx
+	if tableIdx < 0 || tableIdx >= len(iter.tables) {
+		iter.iter = nil
+		return false
+	}
+
+	iter.iter = iter.tables[tableIdx].Iterator()
+	return true
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Builds a memtable holding a version of every key, with the value `key-seq`.
+func newTestMemtable(t *testing.T, sequence uint64, keys ...string) *Memtable {
+	t.Helper()
+
+	memtable := NewMemtable()
+	for _, key := range keys {
+		entry := common.NewEntry(key, fmt.Sprintf("%s-%d", key, sequence))
+		entry.SetSequence(sequence)
+		if err := memtable.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return memtable
+}
+
+func describeTestEntry(entry *common.Entry) string {
+	value, _ := entry.Value()
+	return fmt.Sprintf("%s@%d=%s", entry.Key(), entry.Sequence(), value)
+}
+
+func collectForward(t *testing.T, iter EntryIterator) []string {
+	t.Helper()
+
+	var result []string
+	for iter.Valid() {
+		result = append(result, describeTestEntry(iter.Entry()))
+		if err := iter.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+func collectBackward(t *testing.T, iter EntryIterator) []string {
+	t.Helper()
+
+	var result []string
+	for iter.Valid() {
+		result = append(result, describeTestEntry(iter.Entry()))
+		if err := iter.Prev(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+// Three sources, newest first, with overlapping keys.
+func newTestMergingIterator(t *testing.T) *MergingIterator {
+	return NewMergingIterator([]EntryIterator{
+		newTestMemtable(t, 3, "b", "d").Iterator(),
+		newTestMemtable(t, 2, "a", "b", "e").Iterator(),
+		newTestMemtable(t, 1, "b", "c", "d").Iterator(),
+	})
+}
+
+var testMergedEntries = []string{
+	"a@2=a-2", "b@3=b-3", "b@2=b-2", "b@1=b-1", "c@1=c-1", "d@3=d-3", "d@1=d-1", "e@2=e-2",
+}
+
+func TestMergingIteratorForward(t *testing.T) {
+	iter := newTestMergingIterator(t)
+	if err := iter.SeekToFirst(); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := collectForward(t, iter); !slices.Equal(result, testMergedEntries) {
+		t.Fatalf("got %v", result)
+	}
+}
+
+func TestMergingIteratorReverse(t *testing.T) {
+	iter := newTestMergingIterator(t)
+	if err := iter.SeekToLast(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := slices.Clone(testMergedEntries)
+	slices.Reverse(expected)
+	if result := collectBackward(t, iter); !slices.Equal(result, expected) {
+		t.Fatalf("got %v", result)
+	}
+}
+
+func TestMergingIteratorSeek(t *testing.T) {
+	iter := newTestMergingIterator(t)
+
+	if err := iter.Seek("b"); err != nil {
+		t.Fatal(err)
+	}
+	if result := collectForward(t, iter); !slices.Equal(result, testMergedEntries[1:]) {
+		t.Fatalf("seek to an existing key got %v", result)
+	}
+
+	if err := iter.Seek("bb"); err != nil {
+		t.Fatal(err)
+	}
+	if result := collectForward(t, iter); !slices.Equal(result, testMergedEntries[4:]) {
+		t.Fatalf("seek between keys got %v", result)
+	}
+
+	if err := iter.Seek("f"); err != nil {
+		t.Fatal(err)
+	}
+	if iter.Valid() {
+		t.Fatal("seek past the last key is valid")
+	}
+}
+
+func TestMergingIteratorSeekForPrev(t *testing.T) {
+	iter := newTestMergingIterator(t)
+
+	expected := slices.Clone(testMergedEntries[:4])
+	slices.Reverse(expected)
+
+	// lands on the oldest version of the key
+	if err := iter.SeekForPrev("b"); err != nil {
+		t.Fatal(err)
+	}
+	if result := collectBackward(t, iter); !slices.Equal(result, expected) {
+		t.Fatalf("seek to an existing key got %v", result)
+	}
+
+	if err := iter.SeekForPrev("bb"); err != nil {
+		t.Fatal(err)
+	}
+	if result := collectBackward(t, iter); !slices.Equal(result, expected) {
+		t.Fatalf("seek between keys got %v", result)
+	}
+
+	if err := iter.SeekForPrev("0"); err != nil {
+		t.Fatal(err)
+	}
+	if iter.Valid() {
+		t.Fatal("seek before the first key is valid")
+	}
+}
+
+func TestMergingIteratorChangesDirection(t *testing.T) {
+	iter := newTestMergingIterator(t)
+	if err := iter.Seek("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var result []string
+	steps := []func() error{iter.Prev, iter.Prev, iter.Next, iter.Next, iter.Next, iter.Prev}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, describeTestEntry(iter.Entry()))
+	}
+
+	expected := []string{"b@1=b-1", "b@2=b-2", "b@1=b-1", "c@1=c-1", "d@3=d-3", "c@1=c-1"}
+	if !slices.Equal(result, expected) {
+		t.Fatalf("got %v, expected %v", result, expected)
+	}
+}
+
+func TestSnapshotIteratorHidesNewerAndOlderVersions(t *testing.T) {
+	iter := NewSnapshotIterator(newTestMergingIterator(t), 2)
+	if err := iter.SeekToFirst(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a@2=a-2", "b@2=b-2", "c@1=c-1", "d@1=d-1", "e@2=e-2"}
+	if result := collectForward(t, iter); !slices.Equal(result, expected) {
+		t.Fatalf("forward got %v", result)
+	}
+
+	if err := iter.SeekToLast(); err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Reverse(expected)
+	if result := collectBackward(t, iter); !slices.Equal(result, expected) {
+		t.Fatalf("backward got %v", result)
+	}
+
+	if err := iter.SeekForPrev("c"); err != nil {
+		t.Fatal(err)
+	}
+	if result := collectBackward(t, iter); !slices.Equal(result, expected[2:]) {
+		t.Fatalf("seek for prev got %v", result)
+	}
+}
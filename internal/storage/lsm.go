@@ -2,33 +2,113 @@ package storage
 
 import (
 	"atlas/internal/common"
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"cmp"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// A level is compacted into the next one once it holds more than `MaxTables`
+// tables or more than `MaxSize` bytes. A zero value disables the limit.
 type LsmLevelConfig struct {
 	MaxFileSize uint64
 	MaxTables   int
+	MaxSize     uint64
 }
 
 type LsmConfig struct {
 	Dir    string
 	Levels []LsmLevelConfig
+
+	// Size of the per-table bloom filters. A zero value disables them.
+	BloomBitsPerKey int
+	// Target size of the SSTable data blocks.
+	BlockSize int
+	// Cache of decoded data blocks shared by all tables. Nil disables it.
+	BlockCache *BlockCache
+	// Period of the background removal of tables replaced by compactions.
+	// Defaults to `defaultObsoleteSweepInterval`.
+	ObsoleteSweepInterval time.Duration
+}
+
+// Outcomes of the bloom filter checks done by point lookups:
+//   - Hits - the filter allowed the lookup and the key was in the table
+//   - Misses - the filter ruled the table out without reading it
+//   - FalsePositives - the filter allowed the lookup but the key was absent
+type FilterStats struct {
+	Hits           uint64
+	Misses         uint64
+	FalsePositives uint64
 }
 
+// Reads may run concurrently with each other and with a flush or compaction.
+// Flushes and compactions change the levels and must not run concurrently with
+// each other, the engine runs all of them from a single goroutine.
+//
+// Every flush and compaction installs a new immutable version of the levels.
+// Readers reference the current version for the duration of the read, while
+// a version references each of its tables until its last reader releases it.
+// Tables replaced by a compaction are closed and removed by a background
+// sweeper, or right after a flush or compaction, once no version references
+// them anymore.
 type Lsm struct {
+	// guards the current version, the obsolete tables and the last sequence,
+	// which are only modified by flushes and compactions
+	mutex sync.RWMutex
+	// levels of the current version, read without locking by the flushes and
+	// compactions
+	levels          [][]*SSTable
+	current         *version
+	closed          atomic.Bool
+	obsolete        []*SSTable
+	filterStats     filterCounters
+	manifest        *Manifest
+	nextFileNumber  uint64
+	lastSequence    uint64
+	snapshots       *SnapshotList
+	compactPointers []string
+	config          LsmConfig
+
+	stopSweeper chan struct{}
+	sweeperDone chan struct{}
+}
+
+type version struct {
 	levels [][]*SSTable
-	config LsmConfig
+	// held by the LSM while the version is current and by its readers
+	refs atomic.Int64
+}
+
+// Version of the levels referenced by a reader, whose tables stay open and
+// unchanged by flushes and compactions until it is released.
+type PinnedVersion struct {
+	lsm     *Lsm
+	version *version
+	release sync.Once
+}
+
+type filterCounters struct {
+	hits           atomic.Uint64
+	misses         atomic.Uint64
+	falsePositives atomic.Uint64
 }
 
 var sstableRegex = regexp.MustCompile(`^(\d+)\.sstable$`)
 
+var ErrLsmClosed = errors.New("LSM is closed")
+
+const defaultObsoleteSweepInterval = 10 * time.Second
+
 func InitializeLsm(config LsmConfig) (*Lsm, error) {
 	if err := config.verify(); err != nil {
 		return nil, err
@@ -47,51 +127,166 @@ func InitializeLsm(config LsmConfig) (*Lsm, error) {
 }
 
 func createNewLsm(config LsmConfig) (*Lsm, error) {
+	if err := createLevelDirs(config); err != nil {
+		return nil, err
+	}
+
+	levels := make([][]*SSTable, len(config.Levels))
+	return openLsm(config, levels, 1, 0)
+}
+
+func restoreLsm(config LsmConfig) (*Lsm, error) {
+	if err := createLevelDirs(config); err != nil {
+		return nil, err
+	}
+
 	var levels [][]*SSTable
-	for idx := range config.Levels {
-		dirName := strconv.FormatInt(int64(idx), 10)
-		if err := os.Mkdir(dirName, 0755); err != nil {
+	var nextFileNumber, lastSequence uint64
+	var err error
+	// the tables of a torn edit are left alone, since the manifest no longer
+	// tells for sure which files are live, and their numbers must not be
+	// handed out again
+	truncated := false
+	if manifestExists(config.Dir) {
+		var state *manifestState
+		levels, state, err = restoreLevelsFromManifest(config)
+		if state != nil {
+			nextFileNumber, lastSequence, truncated = state.nextFileNumber, state.lastSequence, state.truncated
+		}
+	} else {
+		levels, nextFileNumber, err = restoreLevelsFromDirectories(config)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if truncated {
+		maxFileNumber, err := maxSSTableNumber(config)
+		if err != nil {
 			return nil, err
 		}
+		nextFileNumber = max(nextFileNumber, maxFileNumber+1)
+	}
+
+	for _, tables := range levels {
+		for _, table := range tables {
+			lastSequence = max(lastSequence, table.lastSequence)
+		}
+	}
+
+	// first level tables may overlap and are kept from the oldest to the
+	// newest, the rest of the levels are ordered by key range
+	for _, tables := range levels[1:] {
+		slices.SortFunc(tables, compareTableRanges)
+	}
 
-		levels = append(levels, nil)
+	lsm, err := openLsm(config, levels, nextFileNumber, lastSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	if truncated {
+		logger.Warn("Keeping the unreferenced SSTables in %s since its manifest was truncated", config.Dir)
+	} else {
+		lsm.removeUnreferencedFiles()
 	}
-	return &Lsm{
-		levels: levels,
-		config: config,
-	}, nil
+	return lsm, nil
 }
 
-func restoreLsm(config LsmConfig) (*Lsm, error) {
-	levels := make([][]*SSTable, len(config.Levels))
+// Starts a fresh manifest from the given levels, so that it does not keep
+// growing with the edits of previous runs.
+func openLsm(
+	config LsmConfig,
+	levels [][]*SSTable,
+	nextFileNumber uint64,
+	lastSequence uint64,
+) (*Lsm, error) {
+	manifest, err := writeManifestSnapshot(config.Dir, levels, nextFileNumber, lastSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	lsm := &Lsm{
+		levels:          levels,
+		current:         newVersion(levels),
+		manifest:        manifest,
+		nextFileNumber:  nextFileNumber,
+		lastSequence:    lastSequence,
+		snapshots:       NewSnapshotList(),
+		compactPointers: make([]string, len(config.Levels)),
+		config:          config,
+		stopSweeper:     make(chan struct{}),
+		sweeperDone:     make(chan struct{}),
+	}
+	go lsm.runSweeper()
+	return lsm, nil
+}
+
+func createLevelDirs(config LsmConfig) error {
 	for levelIdx := range config.Levels {
 		levelDir := filepath.Join(config.Dir, strconv.Itoa(levelIdx))
-
-		sstables, err := restoreSSTablesFromDirectory(levelDir)
-		if err != nil {
-			return nil, err
+		if err := os.MkdirAll(levelDir, 0755); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		levels[levelIdx] = sstables
+func restoreLevelsFromManifest(config LsmConfig) ([][]*SSTable, *manifestState, error) {
+	state, err := readManifest(config.Dir)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return &Lsm{
-		levels: levels,
-		config: config,
-	}, nil
+	levelTables, err := state.levelTables(len(config.Levels))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	levels := make([][]*SSTable, len(config.Levels))
+	for levelIdx, tables := range levelTables {
+		levelDir := filepath.Join(config.Dir, strconv.Itoa(levelIdx))
+		for _, metadata := range tables {
+			filename := filepath.Join(levelDir, buildSSTableFilename(metadata.Number))
+			table, err := RestoreSSTable(filename, config.tableOptions())
+			if err != nil {
+				return nil, nil, err
+			}
+			levels[levelIdx] = append(levels[levelIdx], table)
+		}
+	}
+	return levels, state, nil
 }
 
-func restoreSSTablesFromDirectory(dir string) ([]*SSTable, error) {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return []*SSTable{}, nil
+func restoreLevelsFromDirectories(config LsmConfig) ([][]*SSTable, uint64, error) {
+	levels := make([][]*SSTable, len(config.Levels))
+	var maxFileNumber uint64 = 0
+	for levelIdx := range config.Levels {
+		levelDir := filepath.Join(config.Dir, strconv.Itoa(levelIdx))
+		sstables, levelMaxFileNumber, err := restoreSSTablesFromDirectory(levelDir, config.tableOptions())
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if len(sstables) > 0 {
+			logger.Warn("No manifest found, restored %d SSTables from %s", len(sstables), levelDir)
+		}
+
+		levels[levelIdx] = sstables
+		maxFileNumber = max(maxFileNumber, levelMaxFileNumber)
 	}
+	return levels, maxFileNumber + 1, nil
+}
 
+func restoreSSTablesFromDirectory(dir string, options SSTableOptions) ([]*SSTable, uint64, error) {
 	dirFiles, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var sstables []*SSTable
+	var maxFileNumber uint64 = 0
 	for _, entry := range dirFiles {
 		if entry.IsDir() {
 			continue
@@ -102,23 +297,147 @@ func restoreSSTablesFromDirectory(dir string) ([]*SSTable, error) {
 			continue
 		}
 
+		fileNumber, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
 		filePath := filepath.Join(dir, entry.Name())
-		sstable, err := RestoreSSTable(filePath)
+		sstable, err := RestoreSSTable(filePath, options)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		sstables = append(sstables, sstable)
+		maxFileNumber = max(maxFileNumber, fileNumber)
 	}
-	return sstables, nil
+
+	slices.SortFunc(sstables, func(t1, t2 *SSTable) int {
+		return cmp.Compare(t1.number, t2.number)
+	})
+	return sstables, maxFileNumber, nil
 }
 
-func (lsm *Lsm) MergeWal(wal *Wal) error {
-	return nil
+// Returns the highest number among the SSTable files of every level, whether
+// they are part of a level or not.
+func maxSSTableNumber(config LsmConfig) (uint64, error) {
+	var maxFileNumber uint64 = 0
+	for levelIdx := range config.Levels {
+		dirFiles, err := os.ReadDir(filepath.Join(config.Dir, strconv.Itoa(levelIdx)))
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range dirFiles {
+			matches := sstableRegex.FindStringSubmatch(entry.Name())
+			if entry.IsDir() || len(matches) != 2 {
+				continue
+			}
+
+			number, err := strconv.ParseUint(matches[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			maxFileNumber = max(maxFileNumber, number)
+		}
+	}
+	return maxFileNumber, nil
+}
+
+// Removes the SSTable files which are not part of any level, such as the
+// outputs of a compaction interrupted by a crash.
+func (lsm *Lsm) removeUnreferencedFiles() {
+	live := make(map[string]bool)
+	for _, tables := range lsm.levels {
+		for _, table := range tables {
+			live[table.filename] = true
+		}
+	}
+
+	for levelIdx := range lsm.levels {
+		levelDir := lsm.getLevelDir(levelIdx)
+		dirFiles, err := os.ReadDir(levelDir)
+		if err != nil {
+			logger.Warn("Failed listing SSTables in %s: %v", levelDir, err)
+			continue
+		}
+
+		for _, entry := range dirFiles {
+			if entry.IsDir() || !sstableRegex.MatchString(entry.Name()) {
+				continue
+			}
+
+			filename := filepath.Join(levelDir, entry.Name())
+			if live[filename] {
+				continue
+			}
+
+			logger.Info("Removing unreferenced SSTable %s", filename)
+			if err := os.Remove(filename); err != nil {
+				logger.Warn("Failed removing unreferenced SSTable %s: %v", filename, err)
+			}
+		}
+	}
+}
+
+// Highest sequence persisted in the LSM.
+func (lsm *Lsm) LastSequence() uint64 {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	return lsm.lastSequence
+}
+
+// Live snapshots, whose versions are kept by flushes and compactions.
+func (lsm *Lsm) Snapshots() *SnapshotList {
+	return lsm.snapshots
+}
+
+// Returns the newest version of the key with a sequence not above the given
+// one, read from the current version.
+func (lsm *Lsm) Get(key string, sequence uint64) (*common.Entry, bool, error) {
+	pinned, err := lsm.PinVersion()
+	if err != nil {
+		return nil, false, err
+	}
+	defer pinned.Release()
+	return pinned.Get(key, sequence)
+}
+
+// Pins the current version until `Release` is called.
+func (lsm *Lsm) PinVersion() (*PinnedVersion, error) {
+	version, err := lsm.acquireVersion()
+	if err != nil {
+		return nil, err
+	}
+	return &PinnedVersion{lsm: lsm, version: version}, nil
 }
 
-func (lsm *Lsm) Get(key string) (*common.Entry, bool, error) {
-	for _, level := range lsm.levels {
+// Returns the newest version of the key with a sequence not above the given
+// one. Every version in a level is newer than the versions of the same key in
+// the levels below it.
+func (pinned *PinnedVersion) Get(key string, sequence uint64) (*common.Entry, bool, error) {
+	lsm := pinned.lsm
+	levels := pinned.version.levels
+	// tables in the first level may overlap, so the entry with the highest
+	// sequence among all of them wins, ties going to the newest table
+	var result *common.Entry = nil
+	firstLevel := levels[0]
+	for idx := len(firstLevel) - 1; idx >= 0; idx-- {
+		entry, contains, err := lsm.getFromTable(firstLevel[idx], key, sequence)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if contains && (result == nil || entry.IsNewerThan(result)) {
+			result = entry
+		}
+	}
+
+	if result != nil {
+		return result, true, nil
+	}
+
+	for _, level := range levels[1:] {
 		for _, table := range level {
 			if key > table.maxKey {
 				continue
@@ -128,7 +447,7 @@ func (lsm *Lsm) Get(key string) (*common.Entry, bool, error) {
 				break
 			}
 
-			entry, contains, err := table.Get(key)
+			entry, contains, err := lsm.getFromTable(table, key, sequence)
 			if err != nil {
 				return nil, false, err
 			}
@@ -141,103 +460,322 @@ func (lsm *Lsm) Get(key string) (*common.Entry, bool, error) {
 	return nil, false, nil
 }
 
-func (lsm *Lsm) Merge(wal *Wal) error {
-	entries, err := wal.CloseAndGetEntries()
+// Returns unpositioned iterators over every level ordered from the newest to
+// the oldest, as expected by the `MergingIterator`. Each table of the first
+// level gets its own iterator, deeper levels are iterated as a whole. They
+// must not be used once the version is released.
+func (pinned *PinnedVersion) Iterators() []EntryIterator {
+	var iterators []EntryIterator
+	levels := pinned.version.levels
+	firstLevel := levels[0]
+	for idx := len(firstLevel) - 1; idx >= 0; idx-- {
+		iterators = append(iterators, firstLevel[idx].Iterator())
+	}
+
+	for _, level := range levels[1:] {
+		if len(level) > 0 {
+			iterators = append(iterators, newLevelIterator(level))
+		}
+	}
+	return iterators
+}
+
+// Lets the tables of the version go once no other reader uses them. Safe to
+// call more than once.
+func (pinned *PinnedVersion) Release() {
+	pinned.release.Do(func() {
+		pinned.lsm.releaseVersion(pinned.version)
+	})
+}
+
+// Writes the memtable into a new SSTable in the first level.
+func (lsm *Lsm) Flush(mem *Memtable) error {
+	if mem.Count() == 0 {
+		return nil
+	}
+
+	builder, err := NewSSTableBuilder(lsm.getNewSSTableFilename(0), lsm.config.tableOptions())
 	if err != nil {
 		return err
 	}
 
-	err = lsm.mergeFirstLevel(entries)
+	filter := newVersionFilter(lsm.snapshots.Sequences(), false)
+	if err := mem.Flush(builder, filter.keep); err != nil {
+		builder.Abort()
+		return err
+	}
+
+	table, err := builder.Build()
 	if err != nil {
+		builder.Abort()
 		return err
 	}
 
-	// TODO: subsequent higher level merging
-	return nil
+	if err := utils.SyncDir(lsm.getLevelDir(0)); err != nil {
+		return err
+	}
+
+	lastSequence := max(lsm.lastSequence, mem.LastSequence())
+	edit := &versionEdit{
+		Added:          []tableMetadata{newTableMetadata(0, table)},
+		NextFileNumber: lsm.nextFileNumber,
+		LastSequence:   lastSequence,
+	}
+	if err := lsm.manifest.Append(edit); err != nil {
+		discardTables([]*SSTable{table}, err)
+		return err
+	}
+
+	levels := slices.Clone(lsm.levels)
+	levels[0] = append(slices.Clone(levels[0]), table)
+	lsm.installVersion(levels, nil, lastSequence)
+	return lsm.compact()
 }
 
-func (lsm *Lsm) mergeFirstLevel(walEntries []*common.Entry) error {
-	resultEntries := walEntries
-	for _, table := range lsm.levels[0] {
-		entries, err := getFileEntries(table.file, table.index)
-		if err != nil {
-			return err
+// References the tables of the levels, which must not be modified afterwards.
+func newVersion(levels [][]*SSTable) *version {
+	for _, tables := range levels {
+		for _, table := range tables {
+			table.ref()
 		}
+	}
+
+	version := &version{levels: levels}
+	version.refs.Store(1)
+	return version
+}
+
+// Makes the levels the current version, together with the tables they replace
+// and the last sequence. Runs on the goroutine doing the flushes.
+func (lsm *Lsm) installVersion(levels [][]*SSTable, obsolete []*SSTable, lastSequence uint64) {
+	next := newVersion(levels)
+
+	lsm.mutex.Lock()
+	previous := lsm.current
+	lsm.levels = levels
+	lsm.current = next
+	lsm.obsolete = append(lsm.obsolete, obsolete...)
+	lsm.lastSequence = lastSequence
+	lsm.mutex.Unlock()
+
+	lsm.releaseVersion(previous)
+}
 
-		resultEntries = append(resultEntries, entries...)
+// References the current version until the matching `releaseVersion`.
+func (lsm *Lsm) acquireVersion() (*version, error) {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	if lsm.closed.Load() {
+		return nil, ErrLsmClosed
 	}
 
-	resultEntries = deduplicateAndFilterEntries(resultEntries)
-	slices.SortFunc(resultEntries, common.CompareEntries)
+	lsm.current.refs.Add(1)
+	return lsm.current, nil
+}
+
+// Once the last reader of a replaced version is done, its tables lose their
+// reference. After `Close` the last version referencing a table closes it.
+func (lsm *Lsm) releaseVersion(version *version) {
+	if version.refs.Add(-1) > 0 {
+		return
+	}
 
-	var entryBuckets [][]*common.Entry
-	var currentBucket []*common.Entry
-	var currentBucketSize uint64 = 0
-	firstLevelMaxSize := lsm.config.Levels[0].MaxFileSize
-	for _, entry := range resultEntries {
-		currentBucketSize += uint64(len(entry.Serialize()))
-		currentBucket = append(currentBucket, entry)
-		if currentBucketSize >= firstLevelMaxSize {
-			entryBuckets = append(entryBuckets, currentBucket)
-			currentBucket = nil
-			currentBucketSize = 0
+	for _, tables := range version.levels {
+		for _, table := range tables {
+			if !table.unref() || !lsm.closed.Load() || !table.markClosed() {
+				continue
+			}
+
+			if err := table.Close(); err != nil {
+				logger.Warn("Failed closing SSTable %s: %v", table.filename, err)
+			}
 		}
 	}
+}
+
+func (lsm *Lsm) runSweeper() {
+	defer close(lsm.sweeperDone)
 
-	if len(currentBucket) > 0 {
-		entryBuckets = append(entryBuckets, currentBucket)
+	interval := lsm.config.ObsoleteSweepInterval
+	if interval <= 0 {
+		interval = defaultObsoleteSweepInterval
 	}
 
-	tables := make([]*SSTable, len(entryBuckets))
-	for i, entryBucket := range entryBuckets {
-		var err error
-		tables[i], err = NewSSTable(lsm.getNewSSTableFilename(0), entryBucket)
-		if err != nil {
-			return err
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lsm.stopSweeper:
+			return
+		case <-ticker.C:
+			lsm.removeObsoleteTables()
 		}
 	}
-
-	// TODO:
-	// [ ] old table cleanup
-	lsm.levels[0] = tables
-	return nil
 }
 
-func (lsm *Lsm) getNewSSTableFilename(tableLevel int64) string {
-	timestamp := time.Now().UnixMilli()
-	return path.Join(
-		lsm.config.Dir,
-		strconv.FormatInt(tableLevel, 10),
-		strconv.FormatInt(timestamp, 10),
-	)
+// Closes and removes the tables replaced by compactions which no reader uses
+// anymore. They are out of the levels, so new readers cannot pin them again.
+func (lsm *Lsm) removeObsoleteTables() {
+	lsm.mutex.Lock()
+	var unused []*SSTable
+	lsm.obsolete = slices.DeleteFunc(lsm.obsolete, func(table *SSTable) bool {
+		if table.isUnused() {
+			unused = append(unused, table)
+			return true
+		}
+		return false
+	})
+	lsm.mutex.Unlock()
+
+	for _, table := range unused {
+		if err := table.Remove(); err != nil {
+			logger.Warn("Failed removing obsolete SSTable %s: %v", table.filename, err)
+		}
+	}
 }
 
-func deduplicateAndFilterEntries(entries []*common.Entry) []*common.Entry {
-	if len(entries) == 0 {
-		return entries
+// Hard links the tables of the current version into the directory, next to a
+// manifest holding exactly that version, and returns its last sequence. The
+// version is referenced meanwhile, so that compactions cannot remove its
+// tables, which are copied when the directory is on another file system.
+func (lsm *Lsm) Checkpoint(dir string) (uint64, error) {
+	lsm.mutex.RLock()
+	if lsm.closed.Load() {
+		lsm.mutex.RUnlock()
+		return 0, ErrLsmClosed
+	}
+	version, lastSequence := lsm.current, lsm.lastSequence
+	version.refs.Add(1)
+	lsm.mutex.RUnlock()
+	defer lsm.releaseVersion(version)
+
+	levels := version.levels
+	config := lsm.config
+	config.Dir = dir
+	if err := createLevelDirs(config); err != nil {
+		return 0, err
 	}
 
-	latestEntries := make(map[string]*common.Entry)
-	for _, entry := range entries {
-		key := entry.Key()
-		latestEntry, exists := latestEntries[key]
-		if !exists {
-			latestEntries[key] = entry
+	var nextFileNumber uint64 = 1
+	for levelIdx, tables := range levels {
+		levelDir := filepath.Join(dir, strconv.Itoa(levelIdx))
+		for _, table := range tables {
+			target := filepath.Join(levelDir, filepath.Base(table.filename))
+			if err := linkFile(table.filename, target); err != nil {
+				return 0, err
+			}
+			nextFileNumber = max(nextFileNumber, table.number+1)
 		}
 
-		if entry.Timestamp() > latestEntry.Timestamp() {
-			latestEntries[key] = entry
+		if err := utils.SyncDir(levelDir); err != nil {
+			return 0, err
 		}
 	}
 
-	var result []*common.Entry
-	for _, entry := range latestEntries {
-		if !entry.IsDead() {
-			result = append(result, entry)
+	manifest, err := writeManifestSnapshot(dir, levels, nextFileNumber, lastSequence)
+	if err != nil {
+		return 0, err
+	}
+	return lastSequence, manifest.Close()
+}
+
+// Closes the manifest and the tables no reader uses, the readers still running
+// close the others once they are done. Tables replaced by compactions are
+// removed first, those still read are left for the next start to remove.
+// Expects no flush or compaction to be running, reads started afterwards fail
+// with `ErrLsmClosed`.
+func (lsm *Lsm) Close() error {
+	close(lsm.stopSweeper)
+	<-lsm.sweeperDone
+	lsm.removeObsoleteTables()
+
+	lsm.mutex.Lock()
+	lsm.closed.Store(true)
+	current, obsolete := lsm.current, lsm.obsolete
+	lsm.mutex.Unlock()
+
+	// from here on the release of the last reference to a table closes it,
+	// which covers the tables of the current version once its readers are
+	// done, the obsolete ones may have lost their last reference already
+	lsm.releaseVersion(current)
+
+	var errs []error
+	for _, table := range obsolete {
+		if !table.isUnused() || !table.markClosed() {
+			continue
+		}
+
+		if err := table.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed closing SSTable %s: %w", table.filename, err))
 		}
 	}
 
-	return result
+	if err := lsm.manifest.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("Failed closing manifest: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (lsm *Lsm) BlockCacheStats() BlockCacheStats {
+	return lsm.config.BlockCache.Stats()
+}
+
+func (lsm *Lsm) FilterStats() FilterStats {
+	return FilterStats{
+		Hits:           lsm.filterStats.hits.Load(),
+		Misses:         lsm.filterStats.misses.Load(),
+		FalsePositives: lsm.filterStats.falsePositives.Load(),
+	}
+}
+
+// Consults the bloom filter of the table before reading it. A key present
+// only in versions newer than the sequence counts as a false positive.
+func (lsm *Lsm) getFromTable(table *SSTable, key string, sequence uint64) (*common.Entry, bool, error) {
+	if key < table.minKey || key > table.maxKey || !table.HasFilter() {
+		return table.Get(key, sequence)
+	}
+
+	if !table.MayContain(key) {
+		lsm.filterStats.misses.Add(1)
+		return nil, false, nil
+	}
+
+	entry, contains, err := table.Get(key, sequence)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if contains {
+		lsm.filterStats.hits.Add(1)
+	} else {
+		lsm.filterStats.falsePositives.Add(1)
+	}
+	return entry, contains, nil
+}
+
+func (lsm *Lsm) getNewSSTableFilename(tableLevel int) string {
+	fileNumber := lsm.nextFileNumber
+	lsm.nextFileNumber += 1
+	return path.Join(
+		lsm.getLevelDir(tableLevel),
+		buildSSTableFilename(fileNumber),
+	)
+}
+
+func buildSSTableFilename(fileNumber uint64) string {
+	return fmt.Sprintf("%d.sstable", fileNumber)
+}
+
+func (lsm *Lsm) getLevelDir(tableLevel int) string {
+	return path.Join(lsm.config.Dir, strconv.Itoa(tableLevel))
+}
+
+func (config *LsmConfig) tableOptions() SSTableOptions {
+	return SSTableOptions{
+		BlockSize:       config.BlockSize,
+		BloomBitsPerKey: config.BloomBitsPerKey,
+		BlockCache:      config.BlockCache,
+	}
 }
 
 func (config *LsmConfig) verify() error {
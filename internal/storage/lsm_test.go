@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompactionKeepsTablesOfPinnedVersions(t *testing.T) {
+	config := testLsmConfig(t)
+	config.Levels = []LsmLevelConfig{{MaxFileSize: 1024, MaxTables: 1}, {MaxFileSize: 1024}}
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	flushTestEntries(t, lsm, 0, "a", "b")
+	pinned, err := lsm.PinVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Release()
+
+	// shadows the version of `a`, which the compaction drops
+	flushTestEntries(t, lsm, 2, "a", "c")
+	lsm.removeObsoleteTables()
+
+	entry, contained, err := pinned.Get("a", 1)
+	if err != nil || !contained {
+		t.Fatalf("pinned version lost the version of a read before the compaction: %v", err)
+	}
+
+	if value, _ := entry.Value(); value != "a-1" {
+		t.Fatalf("pinned version read %q", value)
+	}
+	expectTestValueAt(t, lsm, "a", 1, "")
+
+	merged := NewMergingIterator(pinned.Iterators())
+	if err := merged.SeekToFirst(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for ; merged.Valid(); merged.Next() {
+		keys = append(keys, merged.Entry().Key())
+	}
+
+	if fmt.Sprint(keys) != "[a b]" {
+		t.Fatalf("iterator pinned before the compaction read %v", keys)
+	}
+}
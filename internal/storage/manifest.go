@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	manifestFilename     = "MANIFEST"
+	manifestTmpFilename  = "MANIFEST.tmp"
+	manifestRecordHeader = 8
+)
+
+type tableMetadata struct {
+	Level  int    `json:"level"`
+	Number uint64 `json:"number"`
+	MinKey string `json:"minKey,omitempty"`
+	MaxKey string `json:"maxKey,omitempty"`
+}
+
+// A single atomic change to the set of live SSTables.
+type versionEdit struct {
+	Added          []tableMetadata `json:"added,omitempty"`
+	Removed        []tableMetadata `json:"removed,omitempty"`
+	NextFileNumber uint64          `json:"nextFileNumber"`
+	LastSequence   uint64          `json:"lastSequence"`
+}
+
+// Append-only log of version edits. Every record is framed with its length
+// and a CRC32C checksum, so a record torn by a crash is detected and ignored.
+// Only the last record can be torn, a damaged record followed by intact ones
+// is corruption.
+type Manifest struct {
+	file     *os.File
+	filename string
+	// end of the last appended record
+	offset int64
+	// set once an append left the manifest in an unknown state, after which
+	// no edit is accepted anymore
+	err error
+}
+
+type manifestState struct {
+	tables         map[uint64]tableMetadata
+	nextFileNumber uint64
+	lastSequence   uint64
+	// set when a torn record was discarded from the end
+	truncated bool
+}
+
+var errInvalidManifestRecord = errors.New("Failed decoding manifest record - record is truncated or fails its checksum")
+
+// Returned by appends whose edit may or may not be in the manifest, for
+// instance when the sync failed after a complete write. The tables of such an
+// edit must be kept, the next open replays the manifest to tell whether they
+// are live.
+var ErrManifestEditUnknown = errors.New("Failed appending to manifest - outcome of the edit is unknown")
+
+func newTableMetadata(level int, table *SSTable) tableMetadata {
+	return tableMetadata{
+		Level:  level,
+		Number: table.number,
+		MinKey: table.minKey,
+		MaxKey: table.maxKey,
+	}
+}
+
+func manifestExists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, manifestFilename))
+	return err == nil
+}
+
+// Replays the manifest in the directory and returns the resulting set of live
+// tables. A torn record at the end is discarded, while an invalid record
+// followed by intact ones fails the replay, since the edits after it would be
+// lost.
+func readManifest(dir string) (*manifestState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &manifestState{
+		tables:         make(map[uint64]tableMetadata),
+		nextFileNumber: 1,
+	}
+
+	offset := 0
+	for offset < len(data) {
+		edit, read, err := decodeManifestRecord(data[offset:])
+		if errors.Is(err, errInvalidManifestRecord) {
+			if hasIntactManifestRecord(data[offset+1:]) {
+				return nil, fmt.Errorf("%w at offset %d, followed by intact records", err, offset)
+			}
+
+			logger.Warn("Discarding %d bytes of a torn record at the end of the manifest", len(data)-offset)
+			state.truncated = true
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w at offset %d", err, offset)
+		}
+		offset += read
+
+		for _, table := range edit.Removed {
+			delete(state.tables, table.Number)
+		}
+
+		for _, table := range edit.Added {
+			state.tables[table.Number] = table
+		}
+		state.nextFileNumber = max(state.nextFileNumber, edit.NextFileNumber)
+		state.lastSequence = max(state.lastSequence, edit.LastSequence)
+	}
+	return state, nil
+}
+
+// Returns the last sequence recorded in the manifest of the LSM directory,
+// without opening the LSM, which would rewrite its manifest and files.
+func ReadManifestLastSequence(dir string) (uint64, error) {
+	state, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	return state.lastSequence, nil
+}
+
+// Decodes the record at the start of the data and returns the number of bytes
+// it occupies.
+func decodeManifestRecord(data []byte) (*versionEdit, int, error) {
+	if len(data) < manifestRecordHeader {
+		return nil, 0, errInvalidManifestRecord
+	}
+
+	length := binary.LittleEndian.Uint32(data[0:4])
+	checksum := binary.LittleEndian.Uint32(data[4:8])
+	end := manifestRecordHeader + uint64(length)
+	if uint64(len(data)) < end {
+		return nil, 0, errInvalidManifestRecord
+	}
+
+	payload := data[manifestRecordHeader:end]
+	if crc32.Checksum(payload, checksumTable) != checksum {
+		return nil, 0, errInvalidManifestRecord
+	}
+
+	var edit versionEdit
+	if err := json.Unmarshal(payload, &edit); err != nil {
+		return nil, 0, err
+	}
+	return &edit, int(end), nil
+}
+
+// Reports whether an intact record starts anywhere in the data, which tells a
+// damaged record apart from a torn one at the end of the manifest.
+func hasIntactManifestRecord(data []byte) bool {
+	for offset := range data {
+		if _, _, err := decodeManifestRecord(data[offset:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a new manifest holding a single snapshot of the given levels and
+// atomically replaces the current one with it.
+func writeManifestSnapshot(
+	dir string,
+	levels [][]*SSTable,
+	nextFileNumber uint64,
+	lastSequence uint64,
+) (*Manifest, error) {
+	tmpFilename := filepath.Join(dir, manifestTmpFilename)
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePermission)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &versionEdit{
+		NextFileNumber: nextFileNumber,
+		LastSequence:   lastSequence,
+	}
+	for level, tables := range levels {
+		for _, table := range tables {
+			snapshot.Added = append(snapshot.Added, newTableMetadata(level, table))
+		}
+	}
+
+	tmp := &Manifest{file: file, filename: tmpFilename}
+	if err := tmp.Append(snapshot); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	filename := filepath.Join(dir, manifestFilename)
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return nil, err
+	}
+
+	if err := utils.SyncDir(dir); err != nil {
+		return nil, err
+	}
+
+	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{file: file, filename: filename, offset: tmp.offset}, nil
+}
+
+// The edit is durable once this returns. A failed write is truncated away, so
+// that the edit is not in the manifest and later edits follow the last intact
+// record. Failures which leave the edit possibly in the manifest are reported
+// as `ErrManifestEditUnknown`, and fail every later append as well.
+func (manifest *Manifest) Append(edit *versionEdit) error {
+	if manifest.err != nil {
+		return manifest.err
+	}
+
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, manifestRecordHeader+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, checksumTable))
+	copy(record[manifestRecordHeader:], payload)
+
+	written, err := manifest.file.Write(record)
+	if err == nil && written < len(record) {
+		err = errors.New("Failed appending to manifest - partially written record")
+	}
+
+	if err != nil {
+		// a partial record followed by later ones would read as corruption
+		if err := manifest.discardPartialRecord(); err != nil {
+			manifest.err = fmt.Errorf("%w: %w", ErrManifestEditUnknown, err)
+			return manifest.err
+		}
+		return err
+	}
+
+	// the record may have reached the disk before the sync failed, while the
+	// state of the written pages is unknown afterwards
+	if err := manifest.file.Sync(); err != nil {
+		manifest.err = fmt.Errorf("%w: %w", ErrManifestEditUnknown, err)
+		return manifest.err
+	}
+	manifest.offset += int64(len(record))
+	return nil
+}
+
+func (manifest *Manifest) discardPartialRecord() error {
+	if err := manifest.file.Truncate(manifest.offset); err != nil {
+		return err
+	}
+	return manifest.file.Sync()
+}
+
+func (manifest *Manifest) Close() error {
+	return manifest.file.Close()
+}
+
+// Returns the tables of every level ordered from the oldest to the newest.
+func (state *manifestState) levelTables(levelCount int) ([][]tableMetadata, error) {
+	levels := make([][]tableMetadata, levelCount)
+	for _, table := range state.tables {
+		if table.Level < 0 || table.Level >= levelCount {
+			return nil, errors.New("Failed restoring manifest - table level is out of the configured range")
+		}
+		levels[table.Level] = append(levels[table.Level], table)
+	}
+
+	for level := range levels {
+		slices.SortFunc(levels[level], func(t1, t2 tableMetadata) int {
+			return cmp.Compare(t1.Number, t2.Number)
+		})
+	}
+	return levels, nil
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Appends the edits to a new manifest in a temporary directory and returns the
+// directory and the offsets the records start at, followed by the end of the
+// manifest.
+func writeTestManifest(t *testing.T, edits ...*versionEdit) (string, []int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, manifestFilename)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, defaultFilePermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{file: file, filename: filename}
+	offsets := []int{0}
+	for _, edit := range edits {
+		if err := manifest.Append(edit); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, int(stat.Size()))
+	}
+
+	if err := manifest.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, offsets
+}
+
+func modifyTestManifest(t *testing.T, dir string, modify func(data []byte) []byte) {
+	t.Helper()
+
+	filename := filepath.Join(dir, manifestFilename)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, modify(data), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testManifestEdits = []*versionEdit{
+	{
+		Added:          []tableMetadata{{Level: 0, Number: 1}, {Level: 0, Number: 2}},
+		NextFileNumber: 3,
+		LastSequence:   10,
+	},
+	{
+		Added:          []tableMetadata{{Level: 1, Number: 3}},
+		Removed:        []tableMetadata{{Level: 0, Number: 1}, {Level: 0, Number: 2}},
+		NextFileNumber: 4,
+		LastSequence:   10,
+	},
+	{
+		Added:          []tableMetadata{{Level: 0, Number: 4}},
+		NextFileNumber: 5,
+		LastSequence:   20,
+	},
+}
+
+func TestReadManifestReplaysEdits(t *testing.T) {
+	dir, _ := writeTestManifest(t, testManifestEdits...)
+
+	state, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(state.tables) != 2 || state.tables[3].Level != 1 || state.tables[4].Level != 0 {
+		t.Fatalf("replayed tables %v", state.tables)
+	}
+
+	if state.nextFileNumber != 5 || state.lastSequence != 20 || state.truncated {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	levels, err := state.levelTables(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(levels[0]) != 1 || levels[0][0].Number != 4 || len(levels[1]) != 1 || levels[1][0].Number != 3 {
+		t.Fatalf("got levels %v", levels)
+	}
+
+	if _, err := state.levelTables(1); err == nil {
+		t.Fatal("table of a level past the configured ones was accepted")
+	}
+}
+
+func TestReadManifestDiscardsTornTail(t *testing.T) {
+	dir, offsets := writeTestManifest(t, testManifestEdits...)
+	modifyTestManifest(t, dir, func(data []byte) []byte {
+		return data[:offsets[3]-5]
+	})
+
+	state, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !state.truncated || len(state.tables) != 1 || state.lastSequence != 10 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestReadManifestFailsOnCorruptRecordFollowedByIntactOnes(t *testing.T) {
+	corruptions := map[string]func(data []byte, offsets []int) []byte{
+		"payload": func(data []byte, offsets []int) []byte {
+			data[offsets[1]+manifestRecordHeader+2] ^= 0xff
+			return data
+		},
+		"length": func(data []byte, offsets []int) []byte {
+			binary.LittleEndian.PutUint32(data[offsets[1]:], 1<<20)
+			return data
+		},
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			dir, offsets := writeTestManifest(t, testManifestEdits...)
+			modifyTestManifest(t, dir, func(data []byte) []byte {
+				return corrupt(data, offsets)
+			})
+
+			if _, err := readManifest(dir); err == nil {
+				t.Fatal("replaying a corrupt manifest succeeded")
+			}
+
+			if _, err := ReadManifestLastSequence(dir); err == nil {
+				t.Fatal("reading the last sequence of a corrupt manifest succeeded")
+			}
+		})
+	}
+}
+
+func TestLsmKeepsTablesOnCorruptManifest(t *testing.T) {
+	config := testLsmConfig(t)
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for batch := range 3 {
+		flushTestEntries(t, lsm, uint64(batch*10), "a", "b")
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := filepath.Glob(filepath.Join(config.Dir, "*", "*.sstable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the manifest was rewritten as a single snapshot on open, appended to by
+	// the flushes
+	modifyTestManifest(t, config.Dir, func(data []byte) []byte {
+		data[manifestRecordHeader+2] ^= 0xff
+		return data
+	})
+
+	if lsm, err := InitializeLsm(config); err == nil {
+		lsm.Close()
+		t.Fatal("opening an LSM with a corrupt manifest succeeded")
+	}
+
+	for _, table := range tables {
+		if _, err := os.Stat(table); err != nil {
+			t.Fatalf("table %s is gone: %v", table, err)
+		}
+	}
+}
+
+func TestLsmReopensFromManifest(t *testing.T) {
+	config := testLsmConfig(t)
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flushTestEntries(t, lsm, 0, "a", "b")
+	flushTestEntries(t, lsm, 10, "b", "c")
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if lsm.LastSequence() != 12 {
+		t.Fatalf("reopened LSM has last sequence %d", lsm.LastSequence())
+	}
+
+	expectTestValue(t, lsm, "a", "a-1")
+	expectTestValue(t, lsm, "b", "b-11")
+	expectTestValue(t, lsm, "c", "c-12")
+}
+
+func TestManifestAppendFollowsDiscardedPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := writeManifestSnapshot(dir, nil, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+
+	if err := manifest.Append(testManifestEdits[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the start of a record whose write failed
+	if _, err := manifest.file.Write([]byte{0xff, 0xff, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manifest.discardPartialRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manifest.Append(testManifestEdits[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.truncated || len(state.tables) != 1 || state.tables[3].Level != 1 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestLsmKeepsTablesOfUnknownManifestEdits(t *testing.T) {
+	config := testLsmConfig(t)
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flushTestEntries(t, lsm, 0, "a")
+
+	// neither the write nor its truncation succeeds
+	lsm.manifest.file.Close()
+
+	memtable := NewMemtable()
+	entry := common.NewEntry("b", "b-2")
+	entry.SetSequence(2)
+	if err := memtable.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+	memtable.Freeze()
+
+	if err := lsm.Flush(memtable); !errors.Is(err, ErrManifestEditUnknown) {
+		t.Fatalf("flush returned %v", err)
+	}
+
+	if err := lsm.Flush(memtable); !errors.Is(err, ErrManifestEditUnknown) {
+		t.Fatalf("flush after an unknown edit returned %v", err)
+	}
+
+	tables, err := filepath.Glob(filepath.Join(config.Dir, "0", "*.sstable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tables) != 3 {
+		t.Fatalf("found %d tables, expected the flushed one and two of unknown edits", len(tables))
+	}
+	lsm.Close()
+
+	lsm, err = InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	expectTestValue(t, lsm, "a", "a-1")
+	expectTestValue(t, lsm, "b", "")
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"errors"
+	"math/rand/v2"
+	"sync"
+)
+
+const (
+	memtableMaxHeight   = 12
+	memtableBranchRatio = 4
+)
+
+type memtableNode struct {
+	entry *common.Entry
+	next  []*memtableNode
+}
+
+// In-memory table of the most recent writes, kept sorted in a skiplist. Every
+// version of a key is kept, ordered from the newest to the oldest, so that
+// snapshots can read the older ones. Once frozen it becomes immutable and is
+// only read from until it is flushed.
+type Memtable struct {
+	mutex        sync.RWMutex
+	head         *memtableNode
+	height       int
+	count        int
+	size         uint64
+	lastSequence uint64
+	immutable    bool
+}
+
+type MemtableIterator struct {
+	memtable *Memtable
+	node     *memtableNode
+}
+
+func NewMemtable() *Memtable {
+	return &Memtable{
+		head: &memtableNode{
+			entry: nil,
+			next:  make([]*memtableNode, memtableMaxHeight),
+		},
+		height:       1,
+		count:        0,
+		size:         0,
+		lastSequence: 0,
+		immutable:    false,
+	}
+}
+
+func (mem *Memtable) Put(entry *common.Entry) error {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+
+	if mem.immutable {
+		return errors.New("Failed updating memtable - memtable is immutable")
+	}
+
+	mem.lastSequence = max(mem.lastSequence, entry.Sequence())
+
+	var prev [memtableMaxHeight]*memtableNode
+	node := mem.findLast(func(other *common.Entry) bool {
+		return common.CompareVersions(other, entry) < 0
+	}, &prev).next[0]
+
+	// the same version written twice, e.g. when a log is replayed again
+	if node != nil && common.CompareVersions(node.entry, entry) == 0 {
+		mem.size -= entrySize(node.entry)
+		mem.size += entrySize(entry)
+		node.entry = entry
+		return nil
+	}
+
+	height := randomHeight()
+	if height > mem.height {
+		for level := mem.height; level < height; level++ {
+			prev[level] = mem.head
+		}
+		mem.height = height
+	}
+
+	node = &memtableNode{
+		entry: entry,
+		next:  make([]*memtableNode, height),
+	}
+	for level := range height {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+
+	mem.count += 1
+	mem.size += entrySize(entry)
+	return nil
+}
+
+// Returns the newest version of the key with a sequence not above the given
+// one.
+func (mem *Memtable) Get(key string, sequence uint64) (*common.Entry, bool) {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+
+	node := mem.findLast(func(entry *common.Entry) bool {
+		return entry.Key() < key || (entry.Key() == key && entry.Sequence() > sequence)
+	}, nil).next[0]
+	if node == nil || node.entry.Key() != key {
+		return nil, false
+	}
+	return node.entry, true
+}
+
+func (mem *Memtable) Count() int {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+	return mem.count
+}
+
+// Approximate size in bytes of the serialized entries.
+func (mem *Memtable) Size() uint64 {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+	return mem.size
+}
+
+func (mem *Memtable) LastSequence() uint64 {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+	return mem.lastSequence
+}
+
+func (mem *Memtable) Freeze() {
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+	mem.immutable = true
+}
+
+func (mem *Memtable) IsImmutable() bool {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+	return mem.immutable
+}
+
+// Writes the versions accepted by `keep` into the builder. The skiplist is
+// already sorted, so the entries are added as they are iterated.
+func (mem *Memtable) Flush(builder *SSTableBuilder, keep func(*common.Entry) bool) error {
+	iter := mem.Iterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if !keep(iter.Entry()) {
+			continue
+		}
+
+		if err := builder.AddSorted(iter.Entry()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mem *Memtable) Iterator() *MemtableIterator {
+	return &MemtableIterator{
+		memtable: mem,
+		node:     nil,
+	}
+}
+
+func (iter *MemtableIterator) Valid() bool {
+	return iter.node != nil
+}
+
+func (iter *MemtableIterator) Entry() *common.Entry {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	return iter.node.entry
+}
+
+func (iter *MemtableIterator) SeekToFirst() error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	iter.node = iter.memtable.head.next[0]
+	return nil
+}
+
+func (iter *MemtableIterator) SeekToLast() error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	iter.node = iter.memtable.findLastNode(func(*common.Entry) bool { return true })
+	return nil
+}
+
+// Positions the iterator at the newest version of the first key greater or
+// equal to the given one.
+func (iter *MemtableIterator) Seek(key string) error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	iter.node = iter.memtable.findLast(func(entry *common.Entry) bool {
+		return entry.Key() < key
+	}, nil).next[0]
+	return nil
+}
+
+// Positions the iterator at the oldest version of the last key less or equal
+// to the given one.
+func (iter *MemtableIterator) SeekForPrev(key string) error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	iter.node = iter.memtable.findLastNode(func(entry *common.Entry) bool {
+		return entry.Key() <= key
+	})
+	return nil
+}
+
+func (iter *MemtableIterator) Next() error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+	iter.node = iter.node.next[0]
+	return nil
+}
+
+// The skiplist is linked forward only, so stepping back searches for the
+// predecessor from the head.
+func (iter *MemtableIterator) Prev() error {
+	iter.memtable.mutex.RLock()
+	defer iter.memtable.mutex.RUnlock()
+
+	current := iter.node.entry
+	iter.node = iter.memtable.findLastNode(func(entry *common.Entry) bool {
+		return common.CompareVersions(entry, current) < 0
+	})
+	return nil
+}
+
+// Returns the last node whose entry satisfies `before`, or the head when there
+// is none. `before` has to hold for a prefix of the skiplist. Expects the
+// caller to hold the memtable lock. When `prev` is provided it is filled with
+// the last such node on every level.
+func (mem *Memtable) findLast(
+	before func(*common.Entry) bool,
+	prev *[memtableMaxHeight]*memtableNode,
+) *memtableNode {
+	node := mem.head
+	for level := mem.height - 1; level >= 0; level-- {
+		for node.next[level] != nil && before(node.next[level].entry) {
+			node = node.next[level]
+		}
+
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node
+}
+
+// Same as `findLast`, but returns nil instead of the head.
+func (mem *Memtable) findLastNode(before func(*common.Entry) bool) *memtableNode {
+	node := mem.findLast(before, nil)
+	if node == mem.head {
+		return nil
+	}
+	return node
+}
+
+func randomHeight() int {
+	height := 1
+	for height < memtableMaxHeight && rand.IntN(memtableBranchRatio) == 0 {
+		height += 1
+	}
+	return height
+}
+
+func entrySize(entry *common.Entry) uint64 {
+	return uint64(entry.EncodedSize())
+}
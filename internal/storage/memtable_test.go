@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func putTestEntry(t *testing.T, memtable *Memtable, key, value string, sequence uint64) {
+	t.Helper()
+
+	entry := common.NewEntry(key, value)
+	entry.SetSequence(sequence)
+	if err := memtable.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemtableKeepsEntriesSorted(t *testing.T) {
+	memtable := NewMemtable()
+	var keys []string
+	for _, idx := range rand.Perm(500) {
+		key := fmt.Sprintf("key%03d", idx)
+		keys = append(keys, key)
+		putTestEntry(t, memtable, key, "value", uint64(len(keys)))
+	}
+	slices.Sort(keys)
+
+	var iterated []string
+	iter := memtable.Iterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		iterated = append(iterated, iter.Entry().Key())
+	}
+
+	if !slices.Equal(iterated, keys) {
+		t.Fatal("memtable iterated the keys out of order")
+	}
+
+	if memtable.Count() != 500 || memtable.LastSequence() != 500 {
+		t.Fatalf("memtable counts %d entries up to sequence %d", memtable.Count(), memtable.LastSequence())
+	}
+}
+
+func TestMemtableGetReadsVersionAtSequence(t *testing.T) {
+	memtable := NewMemtable()
+	putTestEntry(t, memtable, "a", "a-2", 2)
+	putTestEntry(t, memtable, "a", "a-5", 5)
+	putTestEntry(t, memtable, "c", "c-3", 3)
+
+	tombstone := common.NewEmptyEntry("a")
+	tombstone.SetSequence(7)
+	if err := memtable.Put(tombstone); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, read := range []struct {
+		key      string
+		sequence uint64
+		expected string
+	}{
+		{"a", 1, "absent"},
+		{"a", 2, "a-2"},
+		{"a", 6, "a-5"},
+		{"a", common.MaxSequence, "deleted"},
+		{"b", common.MaxSequence, "absent"},
+		{"c", 3, "c-3"},
+		{"d", common.MaxSequence, "absent"},
+	} {
+		entry, contained := memtable.Get(read.key, read.sequence)
+		result := "absent"
+		if contained {
+			value, isAlive := entry.Value()
+			result = value
+			if !isAlive {
+				result = "deleted"
+			}
+		}
+
+		if result != read.expected {
+			t.Errorf("got %s for %s at sequence %d, expected %s", result, read.key, read.sequence, read.expected)
+		}
+	}
+}
+
+func TestMemtableReplacesRewrittenVersion(t *testing.T) {
+	memtable := NewMemtable()
+	putTestEntry(t, memtable, "a", "first", 1)
+	size := memtable.Size()
+
+	// a replayed log writes the same version again, one byte longer
+	putTestEntry(t, memtable, "a", "second", 1)
+	if memtable.Count() != 1 || memtable.Size() != size+1 {
+		t.Fatalf("memtable counts %d entries of %d bytes", memtable.Count(), memtable.Size())
+	}
+
+	entry, _ := memtable.Get("a", common.MaxSequence)
+	if value, _ := entry.Value(); value != "second" {
+		t.Fatalf("rewritten version holds %q", value)
+	}
+}
+
+func TestFrozenMemtableRejectsWrites(t *testing.T) {
+	memtable := NewMemtable()
+	putTestEntry(t, memtable, "a", "1", 1)
+	memtable.Freeze()
+
+	if err := memtable.Put(common.NewEntry("b", "2")); err == nil || !memtable.IsImmutable() {
+		t.Fatal("frozen memtable accepted a write")
+	}
+
+	if _, contained := memtable.Get("a", common.MaxSequence); !contained {
+		t.Fatal("frozen memtable lost its entries")
+	}
+}
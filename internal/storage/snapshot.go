@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sequences pinned by the live snapshots. Flushes and compactions keep every
+// version that one of them may still read.
+type SnapshotList struct {
+	mutex      sync.Mutex
+	references map[uint64]int
+}
+
+// Decides which versions of a key survive a flush or compaction. The live
+// snapshots split the sequences into stripes, and only the newest version of
+// a key in every stripe can be read by some snapshot or by the latest state.
+type versionFilter struct {
+	snapshots      []uint64
+	dropTombstones bool
+	now            int64
+	lastKey        string
+	lastStripe     int
+	hasLast        bool
+}
+
+func NewSnapshotList() *SnapshotList {
+	return &SnapshotList{
+		references: make(map[uint64]int),
+	}
+}
+
+// Pins the sequence returned by `current`. The sequence is taken under the
+// lock of the list, so that a flush or compaction never misses a snapshot of
+// the writes it holds.
+func (list *SnapshotList) Acquire(current func() uint64) uint64 {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	sequence := current()
+	list.references[sequence] += 1
+	return sequence
+}
+
+func (list *SnapshotList) Release(sequence uint64) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	list.references[sequence] -= 1
+	if list.references[sequence] <= 0 {
+		delete(list.references, sequence)
+	}
+}
+
+// Returns the pinned sequences in ascending order.
+func (list *SnapshotList) Sequences() []uint64 {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	sequences := make([]uint64, 0, len(list.references))
+	for sequence := range list.references {
+		sequences = append(sequences, sequence)
+	}
+	slices.Sort(sequences)
+	return sequences
+}
+
+// Tombstones may be dropped only where nothing older can be left below them,
+// and only in the oldest stripe, since older snapshots need them to hide the
+// versions they shadow. Expired entries read as deleted for every reader, so
+// they are dropped the same way.
+func newVersionFilter(snapshots []uint64, dropTombstones bool) *versionFilter {
+	return &versionFilter{
+		snapshots:      snapshots,
+		dropTombstones: dropTombstones,
+		now:            time.Now().UnixMilli(),
+	}
+}
+
+// Expects the entries in the order of `common.CompareVersions`.
+func (filter *versionFilter) keep(entry *common.Entry) bool {
+	stripe := sort.Search(len(filter.snapshots), func(idx int) bool {
+		return filter.snapshots[idx] >= entry.Sequence()
+	})
+
+	isShadowed := filter.hasLast && filter.lastKey == entry.Key() && filter.lastStripe == stripe
+	filter.lastKey = entry.Key()
+	filter.lastStripe = stripe
+	filter.hasLast = true
+
+	if isShadowed {
+		return false
+	}
+	return entry.IsLive(filter.now) || !filter.dropTombstones || stripe > 0
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"testing"
+)
+
+func TestCompactionKeepsVersionsOfSnapshots(t *testing.T) {
+	config := testLsmConfig(t)
+	config.Levels = []LsmLevelConfig{{MaxFileSize: 1024, MaxTables: 1}, {MaxFileSize: 1024}}
+	lsm, err := InitializeLsm(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	flushTestEntries(t, lsm, 0, "a", "b")
+	snapshot := lsm.Snapshots().Acquire(lsm.LastSequence)
+
+	memtable := NewMemtable()
+	tombstone := common.NewEmptyEntry("a")
+	tombstone.SetSequence(3)
+	if err := memtable.Put(tombstone); err != nil {
+		t.Fatal(err)
+	}
+	flushTestMemtable(t, lsm, memtable)
+	flushTestEntries(t, lsm, 3, "b")
+
+	expectTestValueAt(t, lsm, "a", snapshot, "a-1")
+	expectTestValueAt(t, lsm, "b", snapshot, "b-2")
+	expectTestValue(t, lsm, "a", "")
+	expectTestValue(t, lsm, "b", "b-4")
+
+	// without the snapshot the next compaction drops the old versions
+	lsm.Snapshots().Release(snapshot)
+	flushTestEntries(t, lsm, 4, "c")
+
+	expectTestValueAt(t, lsm, "b", snapshot, "")
+	expectTestValue(t, lsm, "c", "c-5")
+}
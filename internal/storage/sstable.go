@@ -2,146 +2,310 @@ package storage
 
 import (
 	"atlas/internal/common"
-	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Sorted String Table
+//
+// File layout:
+//
+//	header      - file magic and format version
+//	data blocks - sorted entries, split into blocks of roughly `BlockSize`
+//	index block - last key, offset and size of every data block
+//	meta block  - key range, entry count, last sequence and bloom filter
+//	footer      - offsets of the index and meta blocks, format version, magic
+//
+// Every block is followed by the CRC32C checksum of its contents. Opening a
+// table reads only the footer, the index and the meta block.
 type SSTable struct {
-	file     *os.File
-	filename string
-	index    []int64
-	minKey   string
-	maxKey   string
+	file         *os.File
+	filename     string
+	number       uint64
+	blocks       []blockHandle
+	minKey       string
+	maxKey       string
+	count        uint64
+	lastSequence uint64
+	filter       *BloomFilter
+	size         uint64
+	cache        *BlockCache
+
+	// held by every version of the LSM the table is part of
+	refs atomic.Int64
+	// set by whoever closes the table once the LSM is closed
+	closed atomic.Bool
+}
+
+type SSTableOptions struct {
+	// Target size of the data blocks. Defaults to `defaultBlockSize`.
+	BlockSize int
+	// A non-positive value builds tables without a bloom filter.
+	BloomBitsPerKey int
+	// Cache of decoded data blocks shared between tables. Nil disables it.
+	BlockCache *BlockCache
 }
 
 type SSTableBuilder struct {
-	file     *os.File
-	filename string
-	offset   int64
-	index    []int64
-	minKey   string
-	maxKey   string
+	file         *os.File
+	filename     string
+	number       uint64
+	options      SSTableOptions
+	offset       int64
+	block        []byte
+	lastKey      string
+	blocks       []blockHandle
+	minKey       string
+	maxKey       string
+	count        uint64
+	lastSequence uint64
+	filter       *bloomFilterBuilder
 }
 
 type SSTableIterator struct {
-	table     *SSTable
-	peekCache *common.Entry
-	position  int
+	table    *SSTable
+	blockIdx int
+	entries  []*common.Entry
+	entryIdx int
+	// whether the blocks read from disk are added to the block cache
+	fillCache bool
 }
 
-func NewSSTableBuilder(filename string) (*SSTableBuilder, error) {
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	size    int64
+}
+
+const (
+	defaultBlockSize     = 4 * 1024
+	blockChecksumSize    = 4
+	sstableFooterSize    = 44
+	sstableFormatVersion = 1
+)
+
+var (
+	sstableFooterMagic = []byte("ATLASTBL")
+	checksumTable      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func NewSSTableBuilder(filename string, options SSTableOptions) (*SSTableBuilder, error) {
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := writeFileHeader(file, sstableMagic, sstableFormatVersion); err != nil {
+		file.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+
+	if options.BlockSize <= 0 {
+		options.BlockSize = defaultBlockSize
+	}
+
+	var filter *bloomFilterBuilder = nil
+	if options.BloomBitsPerKey > 0 {
+		filter = newBloomFilterBuilder(options.BloomBitsPerKey)
+	}
+
 	return &SSTableBuilder{
 		file:     file,
 		filename: filename,
-		offset:   0,
-		index:    nil,
+		number:   parseSSTableNumber(filename),
+		options:  options,
+		offset:   fileHeaderSize,
+		block:    nil,
+		blocks:   nil,
 		minKey:   "",
 		maxKey:   "",
+		count:    0,
+		filter:   filter,
 	}, nil
 }
 
+// Adds the next entry in the order of `common.CompareVersions`. All versions of
+// a key are kept in the same block.
 func (builder *SSTableBuilder) AddSorted(entry *common.Entry) error {
-	serialized := entry.Serialize()
-	written, err := builder.file.Write([]byte(serialized))
+	isNewKey := builder.count == 0 || entry.Key() != builder.lastKey
+	if isNewKey && len(builder.block) >= builder.options.BlockSize {
+		if err := builder.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	if builder.count == 0 || entry.Key() < builder.minKey {
+		builder.minKey = entry.Key()
+	}
+
+	if builder.count == 0 || entry.Key() > builder.maxKey {
+		builder.maxKey = entry.Key()
+	}
+
+	if builder.filter != nil && isNewKey {
+		builder.filter.Add(entry.Key())
+	}
+
+	builder.block = entry.AppendEncoded(builder.block)
+	builder.lastKey = entry.Key()
+	builder.lastSequence = max(builder.lastSequence, entry.Sequence())
+	builder.count += 1
+	return nil
+}
+
+// Approximate size of the table data written so far.
+func (builder *SSTableBuilder) Size() uint64 {
+	return uint64(builder.offset-fileHeaderSize) + uint64(len(builder.block))
+}
+
+func (builder *SSTableBuilder) Count() int {
+	return int(builder.count)
+}
+
+func (builder *SSTableBuilder) Build() (*SSTable, error) {
+	if err := builder.flushBlock(); err != nil {
+		return nil, err
+	}
+
+	var filter *BloomFilter = nil
+	if builder.filter != nil {
+		filter = builder.filter.Build()
+	}
+
+	table := &SSTable{
+		file:         builder.file,
+		filename:     builder.filename,
+		number:       builder.number,
+		blocks:       builder.blocks,
+		minKey:       builder.minKey,
+		maxKey:       builder.maxKey,
+		count:        builder.count,
+		lastSequence: builder.lastSequence,
+		filter:       filter,
+		cache:        builder.options.BlockCache,
+	}
+
+	indexHandle, err := builder.writeBlock(table.encodeIndex())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if written < len(serialized) {
-		return errors.New("Failed adding to SSTableBuilder - partially written entry")
+	metaHandle, err := builder.writeBlock(table.encodeMeta())
+	if err != nil {
+		return nil, err
 	}
 
-	if builder.minKey > entry.Key() || builder.minKey == "" {
-		builder.minKey = entry.Key()
+	footer := encodeFooter(indexHandle, metaHandle)
+	if err := builder.write(footer); err != nil {
+		return nil, err
 	}
 
-	if builder.maxKey < entry.Key() || builder.maxKey == "" {
-		builder.maxKey = entry.Key()
+	if err := builder.file.Sync(); err != nil {
+		return nil, err
 	}
 
-	builder.offset += int64(written)
-	builder.index = append(builder.index, builder.offset)
+	table.size = uint64(builder.offset)
+	return table, nil
+}
+
+// Discards the partially built table.
+func (builder *SSTableBuilder) Abort() error {
+	if err := builder.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(builder.filename)
+}
+
+func (builder *SSTableBuilder) flushBlock() error {
+	if len(builder.block) == 0 {
+		return nil
+	}
+
+	handle, err := builder.writeBlock(builder.block)
+	if err != nil {
+		return err
+	}
+
+	handle.lastKey = builder.lastKey
+	builder.blocks = append(builder.blocks, handle)
+	builder.block = nil
 	return nil
 }
 
-func (builder *SSTableBuilder) Build() *SSTable {
-	return &SSTable{
-		file:     builder.file,
-		filename: builder.filename,
-		index:    builder.index,
-		minKey:   builder.minKey,
-		maxKey:   builder.maxKey,
+// Writes the block followed by its checksum. The returned handle covers only
+// the block contents.
+func (builder *SSTableBuilder) writeBlock(block []byte) (blockHandle, error) {
+	handle := blockHandle{
+		offset: builder.offset,
+		size:   int64(len(block)),
+	}
+
+	checksummed := binary.LittleEndian.AppendUint32(
+		slices.Clip(block), crc32.Checksum(block, checksumTable),
+	)
+	if err := builder.write(checksummed); err != nil {
+		return blockHandle{}, err
+	}
+	return handle, nil
+}
+
+func (builder *SSTableBuilder) write(data []byte) error {
+	written, err := builder.file.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if written < len(data) {
+		return errors.New("Failed adding to SSTableBuilder - partially written block")
 	}
+
+	builder.offset += int64(written)
+	return nil
 }
 
-func NewSSTable(filename string, entries []*common.Entry) (*SSTable, error) {
+func NewSSTable(filename string, entries []*common.Entry, options SSTableOptions) (*SSTable, error) {
 	if len(entries) == 0 {
 		return nil, errors.New("Failed craeting SSTable - at least 1 entry is required")
 	}
 
-	if !slices.IsSortedFunc(entries, common.CompareEntries) {
-		slices.SortFunc(entries, common.CompareEntries)
+	if !slices.IsSortedFunc(entries, common.CompareVersions) {
+		slices.SortFunc(entries, common.CompareVersions)
 	}
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	builder, err := NewSSTableBuilder(filename, options)
 	if err != nil {
 		return nil, err
 	}
 
-	var offset int64 = 0
-	var index []int64 = nil
-	minKey := entries[0].Key()
-	maxKey := entries[0].Key()
 	for _, entry := range entries {
-		if entry.Key() < minKey {
-			minKey = entry.Key()
-		}
-
-		if entry.Key() > maxKey {
-			maxKey = entry.Key()
-		}
-
-		serialized := entry.Serialize()
-		written, err := file.Write([]byte(serialized))
-		if err != nil {
-			if err := file.Close(); err != nil {
-				return nil, err
-			}
+		if err := builder.AddSorted(entry); err != nil {
+			builder.Abort()
 			return nil, err
 		}
-
-		if written < len(serialized) {
-			if err := file.Close(); err != nil {
-				return nil, err
-			}
-			return nil, errors.New("Failed creating SSTable - partially written entry")
-		}
-
-		offset += int64(written)
-		index = append(index, offset)
 	}
 
-	return &SSTable{
-		file:     file,
-		filename: filename,
-		index:    index,
-		minKey:   minKey,
-		maxKey:   maxKey,
-	}, nil
+	table, err := builder.Build()
+	if err != nil {
+		builder.Abort()
+		return nil, err
+	}
+	return table, nil
 }
 
-func RestoreSSTable(filePath string) (*SSTable, error) {
+// Opens the table reading only its footer, index and meta block. Tables in the
+// text format, which have no file header, are rewritten into the block based
+// layout first.
+func RestoreSSTable(filePath string, options SSTableOptions) (*SSTable, error) {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("SSTable file does not exist: %s", filePath)
 	}
@@ -150,195 +314,529 @@ func RestoreSSTable(filePath string) (*SSTable, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	var index []int64
-	var currentOffset int64 = 0
+	_, hasHeader, err := readFileHeader(file, sstableMagic, sstableFormatVersion)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	minKey := ""
-	maxKey := ""
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
+	if !hasHeader {
+		file.Close()
+		if err := migrateLegacySSTable(filePath, options); err != nil {
+			return nil, err
+		}
+		return RestoreSSTable(filePath, options)
+	}
 
-		// +1 for the newline
-		lineLength := int64(len(line) + 1)
+	table, err := openBlockSSTable(file, filePath, options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return table, nil
+}
 
-		if strings.TrimSpace(line) == "" {
-			currentOffset += lineLength
-			continue
-		}
+func openBlockSSTable(file *os.File, filePath string, options SSTableOptions) (*SSTable, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-		entry, err := common.DeserializeEntry(line)
-		if err != nil {
+	size := stat.Size()
+	footer := make([]byte, sstableFooterSize)
+	hasFooter := size >= fileHeaderSize+sstableFooterSize
+	if hasFooter {
+		if _, err := file.ReadAt(footer, size-sstableFooterSize); err != nil {
 			return nil, err
 		}
+		hasFooter = bytes.Equal(footer[36:], sstableFooterMagic)
+	}
+
+	if !hasFooter {
+		return nil, fmt.Errorf("SSTable is corrupt - missing or damaged footer: %s", filePath)
+	}
 
-		index = append(index, currentOffset)
-		currentOffset += lineLength
+	indexHandle, metaHandle, err := decodeFooter(footer, uint64(size))
+	if err != nil {
+		return nil, fmt.Errorf("SSTable is corrupt - %w: %s", err, filePath)
+	}
 
-		if minKey == "" || entry.Key() < minKey {
-			minKey = entry.Key()
-		}
+	table := &SSTable{
+		file:     file,
+		filename: filePath,
+		number:   parseSSTableNumber(filePath),
+		size:     uint64(size),
+		cache:    options.BlockCache,
+	}
 
-		if maxKey == "" || entry.Key() > maxKey {
-			maxKey = entry.Key()
-		}
+	index, err := table.readBlock(indexHandle)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := table.decodeIndex(index); err != nil {
 		return nil, err
 	}
 
-	sstableFile, err := os.Open(filePath)
+	meta, err := table.readBlock(metaHandle)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SSTable{
-		file:     sstableFile,
-		filename: filePath,
-		index:    index,
-		minKey:   minKey,
-		maxKey:   maxKey,
-	}, nil
+	if err := table.decodeMeta(meta); err != nil {
+		return nil, err
+	}
+	return table, nil
 }
 
-func (table *SSTable) Get(key string) (*common.Entry, bool, error) {
+// Returns the newest version of the key with a sequence not above the given
+// one.
+func (table *SSTable) Get(key string, sequence uint64) (*common.Entry, bool, error) {
 	if key < table.minKey || key > table.maxKey {
 		return nil, false, nil
 	}
 
-	left := 0
-	right := len(table.index) - 1
-	for left <= right {
-		mid := left + (right-left)/2
+	blockIdx := table.findBlock(key)
+	if blockIdx >= len(table.blocks) {
+		return nil, false, nil
+	}
 
-		entry, err := table.getEntryAt(mid)
-		if err != nil {
-			return nil, false, err
-		}
+	entries, err := table.readDataBlock(blockIdx, true)
+	if err != nil {
+		return nil, false, err
+	}
 
-		cmp := strings.Compare(key, entry.Key())
-		if cmp == 0 {
-			return entry, true, nil
-		} else if cmp < 0 {
-			right = mid - 1
-		} else {
-			left = mid + 1
+	entryIdx, _ := slices.BinarySearchFunc(entries, key, compareEntryKey)
+	for ; entryIdx < len(entries) && entries[entryIdx].Key() == key; entryIdx++ {
+		if entries[entryIdx].Sequence() <= sequence {
+			return entries[entryIdx], true, nil
 		}
 	}
-
 	return nil, false, nil
 }
 
+// Reports whether the key may be in the table. Tables without a bloom filter
+// may contain any key.
+func (table *SSTable) MayContain(key string) bool {
+	return table.filter == nil || table.filter.MayContain(key)
+}
+
+func (table *SSTable) HasFilter() bool {
+	return table.filter != nil
+}
+
 func (table *SSTable) Entries() ([]*common.Entry, error) {
-	if len(table.index) == 0 {
-		return []*common.Entry{}, nil
+	result := make([]*common.Entry, 0, table.count)
+	for blockIdx := range table.blocks {
+		entries, err := table.readDataBlock(blockIdx, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entries...)
 	}
+	return result, nil
+}
 
-	offsetIndex := append([]int64{0}, table.index...)
+func (table *SSTable) Count() uint64 {
+	return table.count
+}
 
-	var result []*common.Entry = nil
-	for i, offset := range offsetIndex[1:] {
-		prevOffset := offsetIndex[i]
+// Size of the table file in bytes.
+func (table *SSTable) Size() uint64 {
+	return table.size
+}
 
-		bufferSize := offset - prevOffset
-		buffer := make([]byte, bufferSize)
-		if _, err := table.file.Read(buffer); err != nil {
-			return nil, err
-		}
+func (table *SSTable) Close() error {
+	return table.file.Close()
+}
 
-		entry, err := common.DeserializeEntry(string(buffer))
-		if err != nil {
-			return nil, err
-		}
+func (table *SSTable) ref() {
+	table.refs.Add(1)
+}
 
-		result = append(result, entry)
-	}
+// Reports whether this was the last reference.
+func (table *SSTable) unref() bool {
+	return table.refs.Add(-1) == 0
+}
+
+// Reports whether the caller is the first to close the table.
+func (table *SSTable) markClosed() bool {
+	return table.closed.CompareAndSwap(false, true)
+}
+
+// Reports whether neither the LSM nor any reader uses the table anymore.
+func (table *SSTable) isUnused() bool {
+	return table.refs.Load() == 0
+}
 
-	return nil, nil
+func (table *SSTable) Remove() error {
+	if err := table.Close(); err != nil {
+		return err
+	}
+	return os.Remove(table.filename)
 }
 
 func (table *SSTable) Iterator() *SSTableIterator {
+	return table.iterator(true)
+}
+
+// Iterators reading a whole table once, like the ones of compactions, do not
+// fill the block cache, so that they do not evict the blocks of point reads.
+func (table *SSTable) iterator(fillCache bool) *SSTableIterator {
 	return &SSTableIterator{
 		table:     table,
-		peekCache: nil,
-		position:  0,
+		blockIdx:  -1,
+		entries:   nil,
+		entryIdx:  0,
+		fillCache: fillCache,
 	}
 }
 
-func (iter *SSTableIterator) IsEmpty() bool {
-	return iter.position >= len(iter.table.index)
+func (iter *SSTableIterator) Valid() bool {
+	return iter.entryIdx >= 0 && iter.entryIdx < len(iter.entries)
 }
 
-func (iter *SSTableIterator) Peek() (*common.Entry, bool, error) {
-	if iter.IsEmpty() {
-		return nil, false, nil
+func (iter *SSTableIterator) Entry() *common.Entry {
+	return iter.entries[iter.entryIdx]
+}
+
+func (iter *SSTableIterator) SeekToFirst() error {
+	if err := iter.loadBlock(0); err != nil {
+		return err
 	}
+	iter.entryIdx = 0
+	return nil
+}
 
-	if iter.peekCache != nil {
-		return iter.peekCache, true, nil
+func (iter *SSTableIterator) SeekToLast() error {
+	if err := iter.loadBlock(len(iter.table.blocks) - 1); err != nil {
+		return err
 	}
+	iter.entryIdx = len(iter.entries) - 1
+	return nil
+}
 
-	entry, err := iter.table.getEntryAt(iter.position)
-	if err != nil {
-		return nil, false, err
+// Positions the iterator at the newest version of the first key greater or
+// equal to the given one.
+func (iter *SSTableIterator) Seek(key string) error {
+	blockIdx := iter.table.findBlock(key)
+	if err := iter.loadBlock(blockIdx); err != nil {
+		return err
 	}
 
-	iter.peekCache = entry
-	return entry, true, nil
+	iter.entryIdx, _ = slices.BinarySearchFunc(iter.entries, key, compareEntryKey)
+	return nil
 }
 
-func (iter *SSTableIterator) Advance() (*common.Entry, bool, error) {
-	if iter.IsEmpty() {
-		return nil, false, nil
+// Positions the iterator at the oldest version of the last key less or equal
+// to the given one, which precedes the first entry with a greater key.
+func (iter *SSTableIterator) SeekForPrev(key string) error {
+	blockIdx, _ := slices.BinarySearchFunc(iter.table.blocks, key, func(handle blockHandle, key string) int {
+		if handle.lastKey <= key {
+			return -1
+		}
+		return 1
+	})
+	if blockIdx >= len(iter.table.blocks) {
+		return iter.SeekToLast()
+	}
+
+	if err := iter.loadBlock(blockIdx); err != nil {
+		return err
+	}
+
+	iter.entryIdx, _ = slices.BinarySearchFunc(iter.entries, key, func(entry *common.Entry, key string) int {
+		if entry.Key() <= key {
+			return -1
+		}
+		return 1
+	})
+	return iter.Prev()
+}
+
+func (iter *SSTableIterator) Next() error {
+	iter.entryIdx += 1
+	if iter.entryIdx < len(iter.entries) {
+		return nil
+	}
+
+	if err := iter.loadBlock(iter.blockIdx + 1); err != nil {
+		return err
+	}
+	iter.entryIdx = 0
+	return nil
+}
+
+func (iter *SSTableIterator) Prev() error {
+	iter.entryIdx -= 1
+	if iter.entryIdx >= 0 {
+		return nil
 	}
 
-	if iter.peekCache != nil {
-		result := iter.peekCache
-		iter.peekCache = nil
-		iter.position += 1
-		return result, true, nil
+	if err := iter.loadBlock(iter.blockIdx - 1); err != nil {
+		return err
+	}
+	iter.entryIdx = len(iter.entries) - 1
+	return nil
+}
+
+// Loading a block out of range invalidates the iterator.
+func (iter *SSTableIterator) loadBlock(blockIdx int) error {
+	iter.blockIdx = blockIdx
+	iter.entries = nil
+	iter.entryIdx = -1
+	if blockIdx < 0 || blockIdx >= len(iter.table.blocks) {
+		return nil
 	}
 
-	result, present, err := iter.Peek()
+	entries, err := iter.table.readDataBlock(blockIdx, iter.fillCache)
 	if err != nil {
-		return nil, false, err
+		return err
 	}
 
-	if !present {
-		return nil, false, nil
+	iter.entries = entries
+	return nil
+}
+
+// Returns the index of the first block whose last key is not smaller than the
+// given one, which is the only block that may contain it.
+func (table *SSTable) findBlock(key string) int {
+	blockIdx, _ := slices.BinarySearchFunc(table.blocks, key, func(handle blockHandle, key string) int {
+		return strings.Compare(handle.lastKey, key)
+	})
+	return blockIdx
+}
+
+// Decoded blocks are looked up in the block cache first. Blocks read from disk
+// are added to it when `fillCache` is set.
+func (table *SSTable) readDataBlock(blockIdx int, fillCache bool) ([]*common.Entry, error) {
+	if entries, cached := table.cache.Get(table.number, blockIdx); cached {
+		return entries, nil
 	}
 
-	iter.peekCache = nil
-	iter.position += 1
-	return result, true, nil
+	handle := table.blocks[blockIdx]
+	block, err := table.readBlock(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*common.Entry
+	for len(block) > 0 {
+		entry, read, err := common.DecodeEntry(block)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+		block = block[read:]
+	}
+
+	if fillCache {
+		table.cache.Put(table.number, blockIdx, entries, uint64(handle.size))
+	}
+	return entries, nil
 }
 
-func (table *SSTable) getEntryAt(offsetIdx int) (*common.Entry, error) {
-	var start int64
-	if offsetIdx == 0 {
-		start = 0
-	} else {
-		start = table.index[offsetIdx-1]
+// Reads the block contents and verifies its checksum.
+func (table *SSTable) readBlock(handle blockHandle) ([]byte, error) {
+	if handle.offset < fileHeaderSize || handle.size < 0 ||
+		uint64(handle.offset)+uint64(handle.size)+blockChecksumSize > table.size {
+		return nil, fmt.Errorf("Failed reading SSTable block - block is out of bounds in %s", table.filename)
 	}
 
-	end := table.index[offsetIdx]
-	if _, err := table.file.Seek(start, io.SeekStart); err != nil {
+	buffer := make([]byte, handle.size+blockChecksumSize)
+	if _, err := table.file.ReadAt(buffer, handle.offset); err != nil {
 		return nil, err
 	}
 
-	bufferSize := end - start
-	buffer := make([]byte, bufferSize)
-	read, err := table.file.Read(buffer)
+	block := buffer[:handle.size]
+	checksum := binary.LittleEndian.Uint32(buffer[handle.size:])
+	if crc32.Checksum(block, checksumTable) != checksum {
+		return nil, fmt.Errorf("Failed reading SSTable block - checksum mismatch in %s", table.filename)
+	}
+	return block, nil
+}
+
+func (table *SSTable) encodeIndex() []byte {
+	var buffer []byte
+	for _, handle := range table.blocks {
+		buffer = appendString(buffer, handle.lastKey)
+		buffer = binary.AppendUvarint(buffer, uint64(handle.offset))
+		buffer = binary.AppendUvarint(buffer, uint64(handle.size))
+	}
+	return buffer
+}
+
+func (table *SSTable) decodeIndex(buffer []byte) error {
+	reader := bytes.NewReader(buffer)
+	for reader.Len() > 0 {
+		lastKey, err := readString(reader)
+		if err != nil {
+			return err
+		}
+
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return err
+		}
+
+		handle, err := newBlockHandle(lastKey, offset, size, table.size)
+		if err != nil {
+			return fmt.Errorf("%w in the index of %s", err, table.filename)
+		}
+		table.blocks = append(table.blocks, handle)
+	}
+	return nil
+}
+
+func (table *SSTable) encodeMeta() []byte {
+	var buffer []byte
+	buffer = appendString(buffer, table.minKey)
+	buffer = appendString(buffer, table.maxKey)
+	buffer = binary.AppendUvarint(buffer, table.count)
+	buffer = binary.AppendUvarint(buffer, table.lastSequence)
+	if table.filter == nil {
+		return binary.AppendUvarint(buffer, 0)
+	}
+
+	filter := table.filter.Encode()
+	buffer = binary.AppendUvarint(buffer, uint64(len(filter)))
+	return append(buffer, filter...)
+}
+
+func (table *SSTable) decodeMeta(buffer []byte) error {
+	reader := bytes.NewReader(buffer)
+	var err error
+	if table.minKey, err = readString(reader); err != nil {
+		return err
+	}
+
+	if table.maxKey, err = readString(reader); err != nil {
+		return err
+	}
+
+	if table.count, err = binary.ReadUvarint(reader); err != nil {
+		return err
+	}
+
+	if table.lastSequence, err = binary.ReadUvarint(reader); err != nil {
+		return err
+	}
+
+	filterSize, err := binary.ReadUvarint(reader)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if filterSize == 0 {
+		return nil
+	}
+
+	if filterSize > uint64(reader.Len()) {
+		return errors.New("Failed decoding SSTable meta block - filter is truncated")
+	}
+
+	filterOffset := len(buffer) - reader.Len()
+	table.filter, err = DecodeBloomFilter(buffer[filterOffset : filterOffset+int(filterSize)])
+	return err
+}
+
+// Footer layout, all integers being little endian:
+//
+//	indexOffset uint64
+//	indexSize   uint64
+//	metaOffset  uint64
+//	metaSize    uint64
+//	version     uint32
+//	magic       [8]byte
+func encodeFooter(indexHandle, metaHandle blockHandle) []byte {
+	footer := make([]byte, 0, sstableFooterSize)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexHandle.offset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexHandle.size))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(metaHandle.offset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(metaHandle.size))
+	footer = binary.LittleEndian.AppendUint32(footer, sstableFormatVersion)
+	return append(footer, sstableFooterMagic...)
+}
+
+func decodeFooter(footer []byte, tableSize uint64) (indexHandle, metaHandle blockHandle, err error) {
+	version := binary.LittleEndian.Uint32(footer[32:36])
+	if version != sstableFormatVersion {
+		err = fmt.Errorf("Failed reading SSTable footer - unsupported format version %d", version)
+		return
+	}
+
+	indexHandle, err = newBlockHandle(
+		"",
+		binary.LittleEndian.Uint64(footer[0:8]),
+		binary.LittleEndian.Uint64(footer[8:16]),
+		tableSize,
+	)
+	if err != nil {
+		return
+	}
+
+	metaHandle, err = newBlockHandle(
+		"",
+		binary.LittleEndian.Uint64(footer[16:24]),
+		binary.LittleEndian.Uint64(footer[24:32]),
+		tableSize,
+	)
+	return
+}
+
+// Checks that the decoded block lies between the header and the footer of the
+// table, so that a damaged offset or size is never used to size a read.
+func newBlockHandle(lastKey string, offset, size, tableSize uint64) (blockHandle, error) {
+	dataEnd := tableSize - sstableFooterSize
+	if offset < fileHeaderSize || offset > dataEnd ||
+		size > dataEnd-offset || dataEnd-offset-size < blockChecksumSize {
+		return blockHandle{}, errors.New("Failed reading SSTable - block is out of bounds")
 	}
+	return blockHandle{lastKey: lastKey, offset: int64(offset), size: int64(size)}, nil
+}
+
+func compareEntryKey(entry *common.Entry, key string) int {
+	return strings.Compare(entry.Key(), key)
+}
 
-	if int64(read) < bufferSize {
-		return nil, errors.New("Failed getting SSTable entry - read partial data from file")
+func appendString(buffer []byte, value string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
 	}
 
-	return common.DeserializeEntry(string(buffer))
+	if length > uint64(reader.Len()) {
+		return "", errors.New("Failed decoding string - value is truncated")
+	}
+
+	value := make([]byte, length)
+	if _, err := reader.Read(value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func parseSSTableNumber(filename string) uint64 {
+	matches := sstableRegex.FindStringSubmatch(filepath.Base(filename))
+	if len(matches) != 2 {
+		return 0
+	}
+
+	number, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return number
 }
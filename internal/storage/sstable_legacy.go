@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Rewrites a table written in the `key|value` text format into the block based
+// layout. The new file replaces the old one atomically.
+func migrateLegacySSTable(filePath string, options SSTableOptions) error {
+	logger.Info("Migrating %s to the block based SSTable layout", filePath)
+	entries, err := readLegacyEntries(filePath)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return fmt.Errorf("Failed migrating SSTable - table is empty: %s", filePath)
+	}
+
+	tmpFilename := filePath + ".tmp"
+	os.Remove(tmpFilename)
+	table, err := NewSSTable(tmpFilename, entries, options)
+	if err != nil {
+		return err
+	}
+
+	if err := table.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, filePath); err != nil {
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(filePath))
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestSSTable(t *testing.T, count int) string {
+	t.Helper()
+
+	var entries []*common.Entry
+	for idx := range count {
+		entry := common.NewEntry(fmt.Sprintf("key%04d", idx), fmt.Sprintf("value%d", idx))
+		entry.SetSequence(uint64(idx + 1))
+		entries = append(entries, entry)
+	}
+
+	filename := filepath.Join(t.TempDir(), buildSSTableFilename(1))
+	table, err := NewSSTable(filename, entries, SSTableOptions{BlockSize: 128, BloomBitsPerKey: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestSSTableRoundTrip(t *testing.T) {
+	filename := writeTestSSTable(t, 200)
+
+	table, err := RestoreSSTable(filename, SSTableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.Count() != 200 || table.minKey != "key0000" || table.maxKey != "key0199" || table.lastSequence != 200 {
+		t.Fatalf("unexpected table metadata %d, %s, %s, %d", table.Count(), table.minKey, table.maxKey, table.lastSequence)
+	}
+
+	if len(table.blocks) < 2 || !table.HasFilter() {
+		t.Fatalf("table has %d blocks and filter %t", len(table.blocks), table.HasFilter())
+	}
+
+	for idx := range 200 {
+		key := fmt.Sprintf("key%04d", idx)
+		entry, found, err := table.Get(key, common.MaxSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value, _ := entry.Value(); !found || value != fmt.Sprintf("value%d", idx) {
+			t.Fatalf("got %v, %t for %s", entry, found, key)
+		}
+	}
+
+	if _, found, err := table.Get("key0010", 5); err != nil || found {
+		t.Fatalf("found a version newer than the read sequence: %t, %v", found, err)
+	}
+
+	if _, found, err := table.Get("key0100x", common.MaxSequence); err != nil || found {
+		t.Fatalf("found an absent key: %t, %v", found, err)
+	}
+}
+
+func TestRestoreSSTableReportsDamagedFooter(t *testing.T) {
+	corruptions := map[string]func(footer []byte){
+		"index size":   func(footer []byte) { binary.LittleEndian.PutUint64(footer[8:16], ^uint64(0)) },
+		"index offset": func(footer []byte) { binary.LittleEndian.PutUint64(footer[0:8], ^uint64(0)) },
+		"meta size":    func(footer []byte) { binary.LittleEndian.PutUint64(footer[24:32], 1<<40) },
+		"meta offset":  func(footer []byte) { binary.LittleEndian.PutUint64(footer[16:24], 0) },
+		"version":      func(footer []byte) { binary.LittleEndian.PutUint32(footer[32:36], 7) },
+		"magic":        func(footer []byte) { footer[40] ^= 0xff },
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			filename := writeTestSSTable(t, 50)
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			corrupt(data[len(data)-sstableFooterSize:])
+			if err := os.WriteFile(filename, data, defaultFilePermission); err != nil {
+				t.Fatal(err)
+			}
+
+			if table, err := RestoreSSTable(filename, SSTableOptions{}); err == nil {
+				table.Close()
+				t.Fatal("restoring a table with a damaged footer succeeded")
+			}
+
+			// the damaged table is reported, not migrated or rewritten
+			unchanged, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(unchanged) != string(data) {
+				t.Fatal("restoring changed the damaged table")
+			}
+		})
+	}
+}
+
+func TestRestoreSSTableReportsDamagedIndex(t *testing.T) {
+	filename := writeTestSSTable(t, 50)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	footer := data[len(data)-sstableFooterSize:]
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	data[indexOffset+1] ^= 0xff
+	if err := os.WriteFile(filename, data, defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+
+	if table, err := RestoreSSTable(filename, SSTableOptions{}); err == nil {
+		table.Close()
+		t.Fatal("restoring a table with a damaged index succeeded")
+	}
+}
+
+func TestRestoreSSTableMigratesTextTables(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), buildSSTableFilename(1))
+	if err := os.WriteFile(filename, []byte("a|1\nb|2\nc\n"), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := RestoreSSTable(filename, SSTableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	entries, err := table.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 || entries[2].Key() != "c" || !entries[2].IsDead() {
+		t.Fatalf("migrated table holds %v", entries)
+	}
+
+	if value, _ := entries[1].Value(); value != "2" {
+		t.Fatalf("migrated table holds %q for b", value)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data[:len(sstableMagic)]) != string(sstableMagic) || data[len(sstableMagic)] != sstableFormatVersion {
+		t.Fatal("migrated table has no block table header")
+	}
+}
@@ -3,24 +3,158 @@ package storage
 import (
 	"atlas/internal/common"
 	"atlas/pkg/logger"
+	"atlas/pkg/utils"
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 type WalConfig struct {
-	Dir     string
+	Dir string
+	// Cap on the live log segments. Once it is exceeded the memtable is
+	// flushed early, so that the segments backing it can be removed. Until
+	// that flush completes, the new active segment is live next to them. A
+	// non-positive value disables the cap.
 	MaxLogs int
+
+	// Flush triggers for the memtable, counted over all the segments backing
+	// it. Once either limit is reached the memtable is merged into the LSM and
+	// its segments are removed or archived. A zero value disables the trigger.
+	MaxEntries int
+	MaxSize    uint64
+
+	// Rotation triggers for the active segment. Once either limit is reached
+	// a new segment is started, the sealed one stays until the memtable is
+	// flushed. A zero value disables the trigger.
+	SegmentSize   uint64
+	SegmentMaxAge time.Duration
+
+	// Directory the segments are moved to once flushed, instead of being
+	// removed, so that their writes can be replayed by a point-in-time
+	// recovery. Archiving is disabled when empty.
+	ArchiveDir string
+	// How long archived segments are kept after their last write. A zero
+	// value keeps them forever.
+	ArchiveRetention time.Duration
+
+	// When appended records are forced to disk. Defaults to `WalSyncNone`.
+	SyncMode WalSyncMode
+	// Period of the syncs in `WalSyncInterval` mode. Defaults to
+	// `defaultWalSyncInterval`.
+	SyncInterval time.Duration
+
+	// What replay does with a corrupt record followed by intact ones. A torn
+	// record at the end of the log is always discarded. Defaults to
+	// `WalRecoveryFail`.
+	RecoveryPolicy WalRecoveryPolicy
 }
 
+type WalRecoveryPolicy int
+
+const (
+	// Refuses to open the log, leaving it to be inspected.
+	WalRecoveryFail WalRecoveryPolicy = iota
+	// Drops the corrupt records and replays the ones after them.
+	WalRecoverySkip
+	// Treats the first corrupt record as the end of the log, truncating it
+	// together with everything after it.
+	WalRecoveryStop
+)
+
+// Outcome of replaying a log on startup.
+type WalRecoveryStats struct {
+	Records int
+	Entries int
+	// Corrupt records dropped by `WalRecoverySkip`.
+	SkippedRecords int
+	// Bytes truncated from the end of the log, a torn record or everything
+	// from a corrupt one on with `WalRecoveryStop`.
+	TruncatedBytes int64
+}
+
+type WalSyncMode int
+
+const (
+	// Leaves writing back to the OS, an OS crash or power loss may lose
+	// acknowledged writes.
+	WalSyncNone WalSyncMode = iota
+	// Syncs after every write before acknowledging it.
+	WalSyncAlways
+	// Syncs once for all the writes queued at the same time and acknowledges
+	// them together, trading a little latency for far fewer syncs under load.
+	WalSyncGroup
+	// Syncs in the background every `SyncInterval`, writes acknowledged since
+	// the last sync may be lost.
+	WalSyncInterval
+)
+
+const defaultWalSyncInterval = 100 * time.Millisecond
+
 // Write Ahead Log
+//
+// Every append writes a single record holding a whole batch of entries:
+//
+//	length   uint32 - size of the payload
+//	checksum uint32 - CRC32C of the payload
+//	payload         - uvarint write time in unix milliseconds, uvarint entry
+//	                  count, followed by the encoded entries
+//
+// A batch is replayed only if its record is complete and intact, so either all
+// of its entries are recovered or none of them.
+//
+// The log is written by a single goroutine, `Info` may be called from any.
 type Wal struct {
-	file          *os.File
-	filename      string
-	index         []int64
+	file         *os.File
+	filename     string
+	index        []int64
+	createdAt    time.Time
+	policy       WalRecoveryPolicy
+	recovery     WalRecoveryStats
+	syncedOffset int64
+
+	// guards the fields reported by `Info` against concurrent appends
+	mutex         sync.Mutex
+	count         int
 	currentOffset int64
+	firstSequence uint64
+	lastSequence  uint64
+}
+
+// Batch of entries appended together. Records migrated from logs that did not
+// store write times have a zero timestamp.
+type WalRecord struct {
+	// unix milliseconds
+	Timestamp int64
+	Entries   []*common.Entry
+}
+
+// Description of a log segment. The sequences are zero for an empty one.
+type WalSegmentInfo struct {
+	Filename      string
+	FirstSequence uint64
+	LastSequence  uint64
+	Entries       int
+	Size          uint64
 }
 
-const defaultFilePermission = 0644
+const (
+	defaultFilePermission = 0644
+
+	walFormatVersion    byte = 1
+	walRecordHeaderSize      = 8
+)
+
+var (
+	errTornWalRecord    = errors.New("Failed decoding WAL record - record is truncated")
+	errCorruptWalRecord = errors.New("Failed decoding WAL record - checksum mismatch")
+)
 
 func CreateWal(filename string) (*Wal, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, defaultFilePermission)
@@ -28,40 +162,351 @@ func CreateWal(filename string) (*Wal, error) {
 		return nil, err
 	}
 
-	return &Wal{file, filename, nil, 0}, nil
+	if err := writeFileHeader(file, walMagic, walFormatVersion); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Wal{
+		file:          file,
+		filename:      filename,
+		index:         nil,
+		createdAt:     time.Now(),
+		count:         0,
+		currentOffset: fileHeaderSize,
+		syncedOffset:  0,
+	}, nil
+}
+
+// Opens the log for replay and appends, truncating a torn record at its end.
+// Corrupt records before the end are handled according to the policy.
+func RestoreWal(filename string, policy WalRecoveryPolicy) (*Wal, error) {
+	file, err := openWalFile(filename)
+	if err != nil {
+		logger.Error("Failed restoring WAL file (%s): %v", filename, err)
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	count := 0
+	var firstSequence, lastSequence uint64
+	scan, err := scanWalRecords(file, stat.Size(), policy, func(record WalRecord) {
+		count += len(record.Entries)
+		for _, entry := range record.Entries {
+			if firstSequence == 0 {
+				firstSequence = entry.Sequence()
+			}
+			lastSequence = max(lastSequence, entry.Sequence())
+		}
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed restoring WAL file (%s): %w", filename, err)
+	}
+
+	if scan.skipped > 0 {
+		logger.Warn("Skipped %d corrupt WAL records in %s", scan.skipped, filename)
+	}
+
+	// a trailing partial record is a torn write from a crash during `Append`
+	// and was never acknowledged
+	truncated := stat.Size() - scan.end
+	if truncated > 0 {
+		logger.Warn("Discarding %d bytes of torn or corrupt WAL records at the end of %s", truncated, filename)
+		if err := file.Truncate(scan.end); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := file.Seek(scan.end, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Wal{
+		file:          file,
+		filename:      filename,
+		index:         scan.index,
+		createdAt:     time.Now(),
+		count:         count,
+		currentOffset: scan.end,
+		firstSequence: firstSequence,
+		lastSequence:  lastSequence,
+		syncedOffset:  0,
+		policy:        policy,
+		recovery: WalRecoveryStats{
+			Records:        len(scan.index),
+			Entries:        count,
+			SkippedRecords: scan.skipped,
+			TruncatedBytes: truncated,
+		},
+	}, nil
 }
 
-func RestoreWal(filename string) (*Wal, error) {
+// Opens the WAL file, migrating logs in the text format and writing the
+// header of logs whose creation was interrupted.
+func openWalFile(filename string) (*os.File, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR, 0)
 	if err != nil {
-		logger.Error("Failed restoring WAL file (%s): %v", file, err)
 		return nil, err
 	}
-	return nil, nil
+
+	_, hasHeader, err := readFileHeader(file, walMagic, walFormatVersion)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if hasHeader {
+		return file, nil
+	}
+
+	interrupted, err := isPartialWalHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if interrupted {
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, writeFileHeader(file, walMagic, walFormatVersion)
+	}
+
+	file.Close()
+	if err := migrateLegacyWal(filename); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filename, os.O_RDWR, 0)
 }
 
-func (wal *Wal) Count() int {
-	return len(wal.index)
+// Reports whether the file holds no more than a prefix of the header, which a
+// crash while creating the log leaves behind.
+func isPartialWalHeader(file *os.File) (bool, error) {
+	contents := make([]byte, fileHeaderSize)
+	read, err := file.ReadAt(contents, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	if read == fileHeaderSize {
+		return false, nil
+	}
+	return bytes.HasPrefix(append(bytes.Clone(walMagic), walFormatVersion), contents[:read]), nil
 }
 
-func (wal *Wal) Append(entry *common.Entry) error {
-	serialized := entry.Serialize()
-	written, err := wal.file.Write([]byte(serialized))
+// Rewrites a log in the text format into records of a single entry each. The
+// write times of the text format are unknown and left zero. The new file
+// replaces the old one atomically.
+func migrateLegacyWal(filename string) error {
+	logger.Info("Migrating %s to the binary WAL format", filename)
+	entries, err := readLegacyEntries(filename)
+	if err != nil {
+		return err
+	}
+
+	var records []byte
+	for _, entry := range entries {
+		records = append(records, encodeWalRecord([]*common.Entry{entry}, 0)...)
+	}
+
+	tmpFilename := filename + ".tmp"
+	target, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePermission)
 	if err != nil {
 		return err
 	}
 
-	if written < len(serialized) {
-		return errors.New("Failed appending to WAL - partially written new entry")
+	cleanup := func(err error) error {
+		target.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	if err := writeFileHeader(target, walMagic, walFormatVersion); err != nil {
+		return cleanup(err)
+	}
+
+	if _, err := target.Write(records); err != nil {
+		return cleanup(err)
+	}
+
+	if err := target.Sync(); err != nil {
+		return cleanup(err)
+	}
+
+	if err := target.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(filename))
+}
+
+// Outcome of the replay of a restored log, empty for a new one.
+func (wal *Wal) Recovery() WalRecoveryStats {
+	return wal.recovery
+}
+
+// Number of entries in the log.
+func (wal *Wal) Count() int {
+	return wal.count
+}
+
+func (wal *Wal) Size() uint64 {
+	return uint64(wal.currentOffset - fileHeaderSize)
+}
+
+// Reports whether the segment reached one of the rotation triggers. Empty
+// segments are never rotated.
+func (wal *Wal) NeedsRotation(config WalConfig) bool {
+	if wal.Count() == 0 {
+		return false
+	}
+
+	if config.SegmentSize > 0 && wal.Size() >= config.SegmentSize {
+		return true
+	}
+	return config.SegmentMaxAge > 0 && time.Since(wal.createdAt) >= config.SegmentMaxAge
+}
+
+func (wal *Wal) Info() WalSegmentInfo {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return WalSegmentInfo{
+		Filename:      wal.filename,
+		FirstSequence: wal.firstSequence,
+		LastSequence:  wal.lastSequence,
+		Entries:       wal.count,
+		Size:          uint64(wal.currentOffset - fileHeaderSize),
+	}
+}
+
+// Copies the records appended so far into a new log, while appends may go on,
+// and returns the description of the copy.
+func (wal *Wal) CopyTo(filename string) (WalSegmentInfo, error) {
+	info := wal.Info()
+	info.Filename = filename
+
+	// the segment may have been sealed and closed in the meantime
+	source, err := os.Open(wal.filename)
+	if err != nil {
+		return info, err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFilePermission)
+	if err != nil {
+		return info, err
+	}
+
+	records := io.NewSectionReader(source, 0, fileHeaderSize+int64(info.Size))
+	if _, err := io.Copy(target, records); err != nil {
+		target.Close()
+		return info, err
+	}
+
+	if err := target.Sync(); err != nil {
+		target.Close()
+		return info, err
+	}
+	return info, target.Close()
+}
+
+func (wal *Wal) Filename() string {
+	return wal.filename
+}
+
+func (wal *Wal) Append(entry *common.Entry) error {
+	return wal.AppendBatch([]*common.Entry{entry})
+}
+
+// Appends the entries as a single record, so that they are recovered together.
+func (wal *Wal) AppendBatch(entries []*common.Entry) error {
+	return wal.AppendRecord(WalRecord{Timestamp: time.Now().UnixMilli(), Entries: entries})
+}
+
+// Appends a record keeping its write time, for rewriting records of another
+// log.
+func (wal *Wal) AppendRecord(walRecord WalRecord) error {
+	entries := walRecord.Entries
+	record := encodeWalRecord(entries, walRecord.Timestamp)
+	written, err := wal.file.Write(record)
+	if err == nil && written < len(record) {
+		err = errors.New("Failed appending to WAL - partially written new record")
+	}
+
+	if err != nil {
+		// a partial record followed by later ones would read as corruption
+		if err := wal.discardPartialRecord(); err != nil {
+			logger.Error("Failed discarding partial record from WAL %s: %v", wal.filename, err)
+		}
+		return err
 	}
 
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
 	wal.currentOffset += int64(written)
 	wal.index = append(wal.index, wal.currentOffset)
+	wal.count += len(entries)
+	for _, entry := range entries {
+		if wal.firstSequence == 0 {
+			wal.firstSequence = entry.Sequence()
+		}
+		wal.lastSequence = max(wal.lastSequence, entry.Sequence())
+	}
 	return nil
 }
 
+func (wal *Wal) discardPartialRecord() error {
+	if err := wal.file.Truncate(wal.currentOffset); err != nil {
+		return err
+	}
+
+	_, err := wal.file.Seek(wal.currentOffset, io.SeekStart)
+	return err
+}
+
+func (wal *Wal) Entries() ([]*common.Entry, error) {
+	records, err := wal.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*common.Entry
+	for _, record := range records {
+		result = append(result, record.Entries...)
+	}
+	return result, nil
+}
+
+func (wal *Wal) Records() ([]WalRecord, error) {
+	var result []WalRecord
+	scan, err := scanWalRecords(wal.file, wal.currentOffset, wal.policy, func(record WalRecord) {
+		result = append(result, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if scan.end != wal.currentOffset {
+		return nil, errTornWalRecord
+	}
+	return result, nil
+}
+
 func (wal *Wal) CloseAndGetEntries() ([]*common.Entry, error) {
-	result, err := getFileEntries(wal.file, wal.index)
+	result, err := wal.Entries()
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +517,193 @@ func (wal *Wal) CloseAndGetEntries() ([]*common.Entry, error) {
 	return result, nil
 }
 
+// Forces the appended records to disk. Does nothing when no record was
+// appended since the last sync.
+func (wal *Wal) Sync() error {
+	if wal.syncedOffset == wal.currentOffset {
+		return nil
+	}
+
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	wal.syncedOffset = wal.currentOffset
+	return nil
+}
+
+// Period of the syncs in `WalSyncInterval` mode, with the default applied.
+func (config WalConfig) SyncPeriod() time.Duration {
+	if config.SyncInterval <= 0 {
+		return defaultWalSyncInterval
+	}
+	return config.SyncInterval
+}
+
 func (wal *Wal) Close() error {
 	return wal.file.Close()
 }
+
+func encodeWalRecord(entries []*common.Entry, timestamp int64) []byte {
+	record := make([]byte, walRecordHeaderSize, walRecordHeaderSize+2*binary.MaxVarintLen64)
+	record = binary.AppendUvarint(record, uint64(timestamp))
+	record = binary.AppendUvarint(record, uint64(len(entries)))
+	for _, entry := range entries {
+		record = entry.AppendEncoded(record)
+	}
+
+	payload := record[walRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, checksumTable))
+	return record
+}
+
+// Decodes the record at the start of the buffer and returns the number of
+// bytes it occupies. The size is known for a record failing its checksum too,
+// so that it can be skipped.
+func decodeWalRecord(buffer []byte) (WalRecord, int, error) {
+	record := WalRecord{Timestamp: 0, Entries: nil}
+	if len(buffer) < walRecordHeaderSize {
+		return record, 0, errTornWalRecord
+	}
+
+	length := binary.LittleEndian.Uint32(buffer[0:4])
+	checksum := binary.LittleEndian.Uint32(buffer[4:8])
+	end := walRecordHeaderSize + uint64(length)
+	if uint64(len(buffer)) < end {
+		return record, 0, errTornWalRecord
+	}
+
+	payload := buffer[walRecordHeaderSize:end]
+	if crc32.Checksum(payload, checksumTable) != checksum {
+		return record, int(end), errCorruptWalRecord
+	}
+
+	timestamp, offset := binary.Uvarint(payload)
+	if offset <= 0 {
+		return record, 0, errors.New("Failed decoding WAL record - invalid timestamp")
+	}
+	record.Timestamp = int64(timestamp)
+
+	count, read := binary.Uvarint(payload[offset:])
+	if read <= 0 {
+		return record, 0, errors.New("Failed decoding WAL record - invalid entry count")
+	}
+	offset += read
+
+	record.Entries = make([]*common.Entry, 0, min(count, uint64(len(payload))))
+	for range count {
+		entry, read, err := common.DecodeEntry(payload[offset:])
+		if err != nil {
+			return record, 0, err
+		}
+
+		record.Entries = append(record.Entries, entry)
+		offset += read
+	}
+
+	if offset != len(payload) {
+		return record, 0, errors.New("Failed decoding WAL record - trailing bytes after the entries")
+	}
+	return record, int(end), nil
+}
+
+type walScan struct {
+	// end offsets of the intact records
+	index []int64
+	// where the valid part of the log ends, before a torn record or the
+	// corrupt record replay stopped at
+	end     int64
+	skipped int
+}
+
+// Decodes the records between the file header and `end`. A record cut short at
+// the end, or failing its checksum while ending exactly at `end`, is a torn
+// write and ends the valid part of the log. A record running past `end` while
+// intact records follow it has a damaged length instead. Such records and
+// other records failing their checksum are handled according to the policy,
+// while any other malformed record fails the whole scan.
+func scanWalRecords(
+	file *os.File,
+	end int64,
+	policy WalRecoveryPolicy,
+	onRecord func(WalRecord),
+) (walScan, error) {
+	scan := walScan{index: nil, end: fileHeaderSize, skipped: 0}
+	data, err := io.ReadAll(io.NewSectionReader(file, fileHeaderSize, end-fileHeaderSize))
+	if err != nil {
+		return scan, err
+	}
+
+	for len(data) > 0 {
+		record, read, err := decodeWalRecord(data)
+		if errors.Is(err, errTornWalRecord) {
+			next, found := findIntactWalRecord(data)
+			if !found {
+				return scan, nil
+			}
+			// skipping the record resumes at the first intact one after it
+			read, err = next, errCorruptWalRecord
+		} else if errors.Is(err, errCorruptWalRecord) && isLastWalRecord(data) {
+			return scan, nil
+		}
+
+		if errors.Is(err, errCorruptWalRecord) && policy == WalRecoveryStop {
+			logger.Warn("Stopping WAL replay at corrupt record at offset %d", scan.end)
+			return scan, nil
+		}
+
+		if errors.Is(err, errCorruptWalRecord) && policy == WalRecoverySkip {
+			read, found := skipCorruptWalRecord(data, read)
+			if !found {
+				logger.Warn("Stopping WAL replay at corrupt record at offset %d, no intact record follows", scan.end)
+				return scan, nil
+			}
+
+			data = data[read:]
+			scan.end += int64(read)
+			scan.skipped += 1
+			continue
+		}
+
+		if err != nil {
+			return scan, fmt.Errorf("%w at offset %d", err, scan.end)
+		}
+
+		if onRecord != nil {
+			onRecord(record)
+		}
+
+		data = data[read:]
+		scan.end += int64(read)
+		scan.index = append(scan.index, scan.end)
+	}
+	return scan, nil
+}
+
+// Returns where the record after the corrupt one at the start of the data
+// begins. The length of the corrupt record is trusted only if an intact record
+// follows where it ends.
+func skipCorruptWalRecord(data []byte, read int) (int, bool) {
+	if read > 0 && read < len(data) {
+		if _, _, err := decodeWalRecord(data[read:]); err == nil {
+			return read, true
+		}
+	}
+	return findIntactWalRecord(data)
+}
+
+// Returns the offset of the first intact record after the one at the start of
+// the data, whose length cannot be trusted.
+func findIntactWalRecord(data []byte) (int, bool) {
+	for offset := walRecordHeaderSize; offset+walRecordHeaderSize <= len(data); offset++ {
+		if _, _, err := decodeWalRecord(data[offset:]); err == nil {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+func isLastWalRecord(data []byte) bool {
+	length := binary.LittleEndian.Uint32(data[0:4])
+	return walRecordHeaderSize+uint64(length) == uint64(len(data))
+}
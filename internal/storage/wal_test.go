@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"atlas/internal/common"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a log with a record of two entries for every key and returns the
+// offsets the records start at, followed by the end of the log.
+func writeTestWal(t *testing.T, keys ...string) (string, []int64) {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "00000000000000000001.wal")
+	wal, err := CreateWal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := []int64{fileHeaderSize}
+	sequence := uint64(0)
+	for _, key := range keys {
+		var entries []*common.Entry
+		for idx := range 2 {
+			sequence += 1
+			entry := common.NewEntry(fmt.Sprintf("%s-%d", key, idx), "value")
+			entry.SetSequence(sequence)
+			entries = append(entries, entry)
+		}
+
+		if err := wal.AppendBatch(entries); err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, wal.index[len(wal.index)-1])
+	}
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename, offsets
+}
+
+func modifyTestWal(t *testing.T, filename string, modify func(data []byte) []byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, modify(data), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func restoreTestWal(t *testing.T, filename string, policy WalRecoveryPolicy) ([]string, WalRecoveryStats) {
+	t.Helper()
+
+	wal, err := RestoreWal(filename, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	entries, err := wal.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entry.Key())
+	}
+	return keys, wal.Recovery()
+}
+
+func TestWalRoundTrip(t *testing.T) {
+	filename, offsets := writeTestWal(t, "a", "b", "c")
+
+	keys, stats := restoreTestWal(t, filename, WalRecoveryFail)
+	if fmt.Sprint(keys) != "[a-0 a-1 b-0 b-1 c-0 c-1]" {
+		t.Fatalf("recovered %v", keys)
+	}
+
+	expected := WalRecoveryStats{Records: 3, Entries: 6}
+	if stats != expected {
+		t.Fatalf("got stats %+v, expected %+v", stats, expected)
+	}
+
+	wal, err := RestoreWal(filename, WalRecoveryFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.Size() != uint64(offsets[3]-fileHeaderSize) {
+		t.Fatalf("restored log has size %d, expected %d", wal.Size(), offsets[3]-fileHeaderSize)
+	}
+
+	info := wal.Info()
+	if info.FirstSequence != 1 || info.LastSequence != 6 || info.Entries != 6 {
+		t.Fatalf("unexpected segment info %+v", info)
+	}
+}
+
+func TestWalAppendAfterRestore(t *testing.T) {
+	filename, _ := writeTestWal(t, "a")
+
+	wal, err := RestoreWal(filename, WalRecoveryFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wal.Append(common.NewEntry("b", "value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := restoreTestWal(t, filename, WalRecoveryFail)
+	if fmt.Sprint(keys) != "[a-0 a-1 b]" {
+		t.Fatalf("recovered %v", keys)
+	}
+}
+
+func TestWalTornTailIsTruncated(t *testing.T) {
+	for _, policy := range []WalRecoveryPolicy{WalRecoveryFail, WalRecoverySkip, WalRecoveryStop} {
+		filename, offsets := writeTestWal(t, "a", "b", "c")
+		modifyTestWal(t, filename, func(data []byte) []byte {
+			return data[:offsets[3]-3]
+		})
+
+		keys, stats := restoreTestWal(t, filename, policy)
+		if fmt.Sprint(keys) != "[a-0 a-1 b-0 b-1]" {
+			t.Fatalf("policy %d recovered %v", policy, keys)
+		}
+
+		if stats.TruncatedBytes != offsets[3]-3-offsets[2] {
+			t.Fatalf("policy %d truncated %d bytes", policy, stats.TruncatedBytes)
+		}
+
+		stat, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stat.Size() != offsets[2] {
+			t.Fatalf("policy %d left a log of %d bytes", policy, stat.Size())
+		}
+	}
+}
+
+func TestWalTornLastRecordChecksumIsTruncated(t *testing.T) {
+	filename, offsets := writeTestWal(t, "a", "b")
+	modifyTestWal(t, filename, func(data []byte) []byte {
+		data[offsets[2]-1] ^= 0xff
+		return data
+	})
+
+	keys, stats := restoreTestWal(t, filename, WalRecoveryFail)
+	if fmt.Sprint(keys) != "[a-0 a-1]" || stats.TruncatedBytes != offsets[2]-offsets[1] {
+		t.Fatalf("recovered %v with stats %+v", keys, stats)
+	}
+}
+
+func TestWalCorruptRecordFollowedByIntactOnes(t *testing.T) {
+	corruptions := map[string]func(data []byte, offsets []int64) []byte{
+		"payload": func(data []byte, offsets []int64) []byte {
+			data[offsets[1]+walRecordHeaderSize+2] ^= 0xff
+			return data
+		},
+		"length": func(data []byte, offsets []int64) []byte {
+			binary.LittleEndian.PutUint32(data[offsets[1]:], 1<<20)
+			return data
+		},
+		"short length": func(data []byte, offsets []int64) []byte {
+			length := binary.LittleEndian.Uint32(data[offsets[1]:])
+			binary.LittleEndian.PutUint32(data[offsets[1]:], length-4)
+			return data
+		},
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			filename, offsets := writeTestWal(t, "a", "b", "c")
+			modifyTestWal(t, filename, func(data []byte) []byte {
+				return corrupt(data, offsets)
+			})
+
+			if wal, err := RestoreWal(filename, WalRecoveryFail); err == nil {
+				wal.Close()
+				t.Fatal("restoring a corrupt log succeeded with the fail policy")
+			}
+
+			stat, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stat.Size() != offsets[3] {
+				t.Fatalf("failed restore changed the log size to %d", stat.Size())
+			}
+
+			keys, stats := restoreTestWal(t, filename, WalRecoverySkip)
+			if fmt.Sprint(keys) != "[a-0 a-1 c-0 c-1]" || stats.SkippedRecords != 1 {
+				t.Fatalf("skip policy recovered %v with stats %+v", keys, stats)
+			}
+		})
+	}
+}
+
+func TestWalStopPolicyTruncatesAtCorruptRecord(t *testing.T) {
+	filename, offsets := writeTestWal(t, "a", "b", "c")
+	modifyTestWal(t, filename, func(data []byte) []byte {
+		data[offsets[1]+walRecordHeaderSize+2] ^= 0xff
+		return data
+	})
+
+	keys, stats := restoreTestWal(t, filename, WalRecoveryStop)
+	if fmt.Sprint(keys) != "[a-0 a-1]" || stats.TruncatedBytes != offsets[3]-offsets[1] {
+		t.Fatalf("recovered %v with stats %+v", keys, stats)
+	}
+}
+
+func TestRestoreWalMigratesTextLogs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "00000000000000000001.wal")
+	if err := os.WriteFile(filename, []byte("a|1\nb\nc|3\nd|"), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := RestoreWal(filename, WalRecoveryFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the partial last line is a torn write
+	if len(records) != 3 {
+		t.Fatalf("migrated %d records", len(records))
+	}
+
+	for idx, key := range []string{"a", "b", "c"} {
+		record := records[idx]
+		if len(record.Entries) != 1 || record.Entries[0].Key() != key || record.Timestamp != 0 {
+			t.Fatalf("migrated record %d is %+v", idx, record)
+		}
+	}
+
+	if !records[1].Entries[0].IsDead() {
+		t.Fatal("deletion was migrated as a write")
+	}
+
+	// the migrated log is appended to like any other
+	if err := wal.Append(common.NewEntry("e", "5")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := restoreTestWal(t, filename, WalRecoveryFail)
+	if fmt.Sprint(keys) != "[a b c e]" {
+		t.Fatalf("recovered %v", keys)
+	}
+}
+
+func TestRestoreWalCompletesInterruptedHeader(t *testing.T) {
+	for _, size := range []int{0, 3, fileHeaderSize - 1} {
+		filename := filepath.Join(t.TempDir(), "00000000000000000001.wal")
+		header := append([]byte(string(walMagic)), walFormatVersion)
+		if err := os.WriteFile(filename, header[:size], defaultFilePermission); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, stats := restoreTestWal(t, filename, WalRecoveryFail)
+		if len(keys) != 0 || stats.Records != 0 {
+			t.Fatalf("log with %d header bytes recovered %v", size, keys)
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != string(header) {
+			t.Fatalf("log with %d header bytes holds %q", size, data)
+		}
+	}
+}
+
+func TestRestoreWalMigratesShortTextLogs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "00000000000000000001.wal")
+	if err := os.WriteFile(filename, []byte("a|1\n"), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := restoreTestWal(t, filename, WalRecoveryFail)
+	if fmt.Sprint(keys) != "[a]" {
+		t.Fatalf("recovered %v", keys)
+	}
+}
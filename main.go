@@ -1,10 +1,20 @@
 package main
 
 import (
+	"atlas/internal/backup"
 	"atlas/internal/engine"
 	"atlas/internal/storage"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 const (
@@ -14,27 +24,243 @@ const (
 	gb
 )
 
+const (
+	defaultServerAddress = "http://localhost:8080"
+	defaultServerPort    = 8080
+)
+
 func main() {
-	_, err := engine.NewAtlas(engine.AtlasConfig{
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		runServe(args)
+	case "recover":
+		runRecover(args)
+	case "checkpoint":
+		runCheckpoint(args)
+	case "backup":
+		runBackup(args)
+	default:
+		log.Fatalf("Usage: atlas <serve|recover|checkpoint|backup> [args]")
+	}
+}
+
+// Engine config keeping the store in the `lsm` and `wal` subdirectories of the
+// data directory.
+func defaultAtlasConfig(dataDir, archiveDir string) engine.AtlasConfig {
+	return engine.AtlasConfig{
 		Lsm: storage.LsmConfig{
-			Dir: "~/atlas/lsm",
+			Dir: filepath.Join(dataDir, "lsm"),
 			Levels: []storage.LsmLevelConfig{
-				{MaxFileSize: 10 * kb},
-				{MaxFileSize: 100 * kb},
-				{MaxFileSize: 1 * mb},
-				{MaxFileSize: 10 * mb},
+				{MaxFileSize: 10 * kb, MaxTables: 4},
+				{MaxFileSize: 100 * kb, MaxSize: 10 * mb},
+				{MaxFileSize: 1 * mb, MaxSize: 100 * mb},
+				{MaxFileSize: 10 * mb, MaxSize: 1 * gb},
 				{MaxFileSize: 100 * mb},
 			},
+			BloomBitsPerKey: 10,
 		},
 		Wal: storage.WalConfig{
-			Dir:     "~/atlas/wal",
-			MaxLogs: -1,
+			Dir:         filepath.Join(dataDir, "wal"),
+			MaxLogs:     -1,
+			MaxSize:     1 * mb,
+			SegmentSize: 256 * kb,
+			ArchiveDir:  archiveDir,
 		},
+		BlockCacheSize: 64 * mb,
+	}
+}
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("Failed locating the home directory: %v", err)
+	}
+	return filepath.Join(home, "atlas")
+}
+
+// Serves the store in the data directory, or the checkpoint given with
+// `-from-checkpoint`, until SIGINT or SIGTERM. A checkpoint is opened in place
+// and so modified by the writes, serve a copy of it to keep it intact.
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.Int("port", defaultServerPort, "port the server listens on")
+	dataDir := flags.String("dir", defaultDataDir(), "directory of the store")
+	archiveDir := flags.String("archive-dir", "", "directory flushed WAL segments are archived into, disabled when empty")
+	checkpointDir := flags.String("checkpoint-dir", "", "directory checkpoints are written into, disabled when empty")
+	fromCheckpoint := flags.String("from-checkpoint", "", "checkpoint to serve instead of the data directory")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		log.Fatalf("Usage: atlas serve [-port port] [-dir dir] [-archive-dir dir] [-checkpoint-dir dir] [-from-checkpoint dir]")
+	}
+
+	config := defaultAtlasConfig(*dataDir, *archiveDir)
+	if *fromCheckpoint != "" {
+		var err error
+		config, err = engine.CheckpointConfig(*fromCheckpoint, config)
+		if err != nil {
+			log.Fatalf("Failed opening checkpoint %s: %v", *fromCheckpoint, err)
+		}
+	}
+
+	server, err := engine.CreateAtlasServer(engine.AtlasServerConfig{
+		Engine:        config,
+		Port:          *port,
+		CheckpointDir: *checkpointDir,
 	})
+	if err != nil {
+		log.Fatalf("Failed booting up Atlas server: %v", err)
+	}
+	server.Start()
+}
+
+// Rebuilds the store in the data directory from a checkpoint and the archived
+// WAL segments, up to the given sequence or time. The server must not be
+// running meanwhile.
+func runRecover(args []string) {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	dataDir := flags.String("dir", defaultDataDir(), "directory of the store")
+	archiveDir := flags.String("archive-dir", "", "directory of the archived WAL segments")
+	sequence := flags.Uint64("sequence", 0, "last sequence to recover, zero for no limit")
+	until := flags.String("time", "", "recovers only the writes made up to this RFC 3339 time")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *archiveDir == "" {
+		log.Fatalf("Usage: atlas recover -archive-dir <dir> [-dir dir] [-sequence n] [-time time] <checkpoint dir>")
+	}
 
+	target := engine.RecoveryTarget{Sequence: *sequence}
+	if *until != "" {
+		var err error
+		target.Time, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			log.Fatalf("Invalid recovery time: %v", err)
+		}
+	}
+
+	recovered, err := engine.RecoverToPoint(defaultAtlasConfig(*dataDir, *archiveDir), flags.Arg(0), target)
 	if err != nil {
-		log.Fatal("Failed booting up Atlas engine: %v", err)
+		log.Fatalf("Failed recovering: %v", err)
 	}
+	fmt.Printf("Recovered up to sequence %d\n", recovered)
+}
 
-	fmt.Printf("Hello world\n")
+// Asks a running server to write a checkpoint under the given name into its
+// checkpoint directory.
+func runCheckpoint(args []string) {
+	flags := flag.NewFlagSet("checkpoint", flag.ExitOnError)
+	address := flags.String("addr", defaultServerAddress, "address of the Atlas server")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("Usage: atlas checkpoint [-addr address] <name>")
+	}
+
+	body, err := requestCheckpoint(*address, flags.Arg(0))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Print(string(body))
+}
+
+func requestCheckpoint(address, name string) ([]byte, error) {
+	endpoint := address + "/v1/admin/checkpoint?" + url.Values{"name": {name}}.Encode()
+	response, err := http.Post(endpoint, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed requesting checkpoint: %w", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading checkpoint response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("Failed writing checkpoint: %s", strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Manages the backup repository, `create` backs up a running server, which
+// has to run on the same host and have checkpoints enabled. Unchanged SSTables
+// are only skipped without being read when the checkpoint directory of the
+// server is on the file system of the store.
+func runBackup(args []string) {
+	usage := "Usage: atlas backup <create|list|verify|restore|purge> -repo <dir> [args]"
+	if len(args) == 0 {
+		log.Fatalf("%s", usage)
+	}
+
+	flags := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	repoDir := flags.String("repo", "", "backup repository directory")
+	address := flags.String("addr", defaultServerAddress, "address of the Atlas server")
+	keepLast := flags.Int("keep", 0, "number of backups kept by purge")
+	maxAge := flags.Duration("max-age", 0, "age of the backups removed by purge")
+	flags.Parse(args[1:])
+	if *repoDir == "" {
+		log.Fatalf("%s", usage)
+	}
+
+	repo, err := backup.Open(*repoDir)
+	if err != nil {
+		log.Fatalf("Failed opening backup repository: %v", err)
+	}
+
+	switch args[0] {
+	case "create":
+		name := fmt.Sprintf("backup-%d", time.Now().UnixNano())
+		body, err := requestCheckpoint(*address, name)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		var checkpoint struct{ Dir string }
+		if err := json.Unmarshal(body, &checkpoint); err != nil {
+			log.Fatalf("Malformed checkpoint response: %v", err)
+		}
+		defer os.RemoveAll(checkpoint.Dir)
+
+		created, err := repo.Import(checkpoint.Dir)
+		if err != nil {
+			log.Fatalf("Failed creating backup: %v", err)
+		}
+		fmt.Printf("Created backup %s at sequence %d, adding %d bytes\n", created.ID, created.Sequence, created.AddedSize)
+	case "list":
+		backups, err := repo.List()
+		if err != nil {
+			log.Fatalf("Failed listing backups: %v", err)
+		}
+
+		for _, listed := range backups {
+			fmt.Printf("%s\tsequence %d\t%d files\n", listed.ID, listed.Sequence, len(listed.Files))
+		}
+	case "verify":
+		if flags.NArg() != 1 {
+			log.Fatalf("Usage: atlas backup verify -repo <dir> <id>")
+		}
+
+		if err := repo.Verify(flags.Arg(0)); err != nil {
+			log.Fatalf("Backup %s is damaged: %v", flags.Arg(0), err)
+		}
+		fmt.Printf("Backup %s is intact\n", flags.Arg(0))
+	case "restore":
+		if flags.NArg() != 2 {
+			log.Fatalf("Usage: atlas backup restore -repo <dir> <id> <target dir>")
+		}
+
+		if err := repo.Restore(flags.Arg(0), flags.Arg(1)); err != nil {
+			log.Fatalf("Failed restoring backup: %v", err)
+		}
+	case "purge":
+		removed, err := repo.Purge(backup.RetentionPolicy{KeepLast: *keepLast, MaxAge: *maxAge})
+		if err != nil {
+			log.Fatalf("Failed purging backups: %v", err)
+		}
+		fmt.Printf("Removed %d backups\n", len(removed))
+	default:
+		log.Fatalf("%s", usage)
+	}
 }
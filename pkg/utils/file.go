@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// Copies the file into a new one and syncs it. A target left incomplete by a
+// failure is removed.
+func CopyFile(source, target string, permission os.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, permission)
+	if err != nil {
+		return err
+	}
+
+	cleanup := func(err error) error {
+		targetFile.Close()
+		os.Remove(target)
+		return err
+	}
+
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		return cleanup(err)
+	}
+
+	if err := targetFile.Sync(); err != nil {
+		return cleanup(err)
+	}
+
+	if err := targetFile.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// Makes the creation, removal and renaming of the entries of the directory
+// durable.
+func SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}